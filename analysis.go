@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DBAnalysisPath is the path to the image analyses in the database
+const DBAnalysisPath = "analysis"
+
+// Analysis is the first description Gemini gave of an image, reused as
+// context when the user asks to calc or cook it.
+type Analysis struct {
+	Description string `json:"description"`
+	Time        int64  `json:"time"`
+}
+
+// analysisPath returns the path of the analysis of a user's image message.
+func analysisPath(uID, messageID string) string {
+	return fmt.Sprintf("%s/%s/%s", DBAnalysisPath, uID, messageID)
+}
+
+// SaveAnalysis stores the description of an image message.
+func SaveAnalysis(ctx context.Context, uID, messageID, description string) error {
+	return foodDB.SetDB(ctx, analysisPath(uID, messageID), Analysis{
+		Description: description,
+		Time:        time.Now().Unix(),
+	})
+}
+
+// GetAnalysis returns the description of an image message, empty if the
+// image was never analyzed.
+func GetAnalysis(ctx context.Context, uID, messageID string) (string, error) {
+	var a Analysis
+	if err := foodDB.GetFromDB(ctx, analysisPath(uID, messageID), &a); err != nil {
+		return "", err
+	}
+	return a.Description, nil
+}
+
+// GetAnalyses returns the descriptions of all the images of a user, by
+// message ID.
+func GetAnalyses(ctx context.Context, uID string) (map[string]Analysis, error) {
+	var analyses map[string]Analysis
+	err := foodDB.GetFromDB(ctx, fmt.Sprintf("%s/%s", DBAnalysisPath, uID), &analyses)
+	return analyses, err
+}
+
+// withAnalysis: Add the earlier description of the image to a prompt.
+func withAnalysis(prompt, description string) string {
+	if description == "" {
+		return prompt
+	}
+	return fmt.Sprintf("%s\n\n這張照片先前的分析如下，請與它保持一致:\n%s", prompt, description)
+}
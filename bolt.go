@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBucket is the bucket holding every record of the bot.
+var boltBucket = []byte("data")
+
+// BoltDB is an embedded on-disk FoodStore. Records are kept as JSON under
+// their full path, so it follows the same tree layout as the Firebase
+// Realtime Database.
+type BoltDB struct {
+	*bolt.DB
+}
+
+// initBoltDB: Open (or create) the bolt database file.
+func initBoltDB(file string) (*BoltDB, error) {
+	log.Println("initBoltDB:", file)
+
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDB{DB: db}, nil
+}
+
+// GetFromDB reads the record stored at path, or all of its children when
+// path is a parent node.
+func (b *BoltDB) GetFromDB(ctx context.Context, path string, data interface{}) error {
+	path = strings.Trim(path, "/")
+	return b.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if v := bucket.Get([]byte(path)); v != nil {
+			return json.Unmarshal(v, data)
+		}
+
+		tree := map[string]interface{}{}
+		prefix := []byte(path + "/")
+		c := bucket.Cursor()
+		for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+			insertTree(tree, strings.Split(string(k[len(prefix):]), "/"), json.RawMessage(v))
+		}
+		if len(tree) == 0 {
+			return nil
+		}
+		raw, err := json.Marshal(tree)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(raw, data)
+	})
+}
+
+// InsertDB pushes data as a new child of path and returns its key.
+func (b *BoltDB) InsertDB(ctx context.Context, path string, data interface{}) (string, error) {
+	path = strings.Trim(path, "/")
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	var key string
+	err = b.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key = pushKey(seq)
+		return bucket.Put([]byte(path+"/"+key), raw)
+	})
+	return key, err
+}
+
+// SetDB writes data at path, replacing the record and its children.
+func (b *BoltDB) SetDB(ctx context.Context, path string, data interface{}) error {
+	path = strings.Trim(path, "/")
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return b.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if err := deleteTree(bucket, path); err != nil {
+			return err
+		}
+		return bucket.Put([]byte(path), raw)
+	})
+}
+
+// DeleteDB removes the record at path and all of its children.
+func (b *BoltDB) DeleteDB(ctx context.Context, path string) error {
+	path = strings.Trim(path, "/")
+	return b.Update(func(tx *bolt.Tx) error {
+		return deleteTree(tx.Bucket(boltBucket), path)
+	})
+}
+
+// deleteTree removes the record at path and all of its children.
+func deleteTree(bucket *bolt.Bucket, path string) error {
+	if err := bucket.Delete([]byte(path)); err != nil {
+		return err
+	}
+	prefix := []byte(path + "/")
+	c := bucket.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, _ = c.Seek(prefix) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushKey returns a child key that sorts in insertion order.
+func pushKey(seq uint64) string {
+	return fmt.Sprintf("-%015d", seq)
+}
+
+// insertTree places value in tree at the nested location given by keys.
+func insertTree(tree map[string]interface{}, keys []string, value json.RawMessage) {
+	for _, k := range keys[:len(keys)-1] {
+		child, ok := tree[k].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			tree[k] = child
+		}
+		tree = child
+	}
+	tree[keys[len(keys)-1]] = value
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,6 +9,8 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/line/line-bot-sdk-go/v7/linebot"
 	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
@@ -16,23 +19,56 @@ import (
 
 // Const variables of Prompts.
 const ImagePrompt = "你是一個美食烹飪專家，根據這張圖片給予相關的食物敘述，越詳細越好。"
-const CalcPrompt = "根據這張圖片，試著估算圖片食物的卡路里。 根據以下格式給我 food(name, calories), 只要給我 JSON 就好。"
+const CalcPrompt = "根據這張圖片，試著估算圖片中每一道食物的份量、卡路里與營養素 (蛋白質、碳水化合物、脂肪、膳食纖維、糖以公克計，鈉以毫克計)，並給出估算的信心程度 (0 到 1)。每一道食物列為一個項目，只要給我 JSON 就好。"
 const CookPrompt = "根據這張圖片，幫我找到相關的食譜。盡可能詳細列出烹煮步驟跟所需要材料，謝謝。"
+const CookTextPrompt = "根據以下這道料理的描述，幫我找到相關的食譜。盡可能詳細列出烹煮步驟跟所需要材料，謝謝。"
 
 // Image statics link.
 const CalcImg = "https://raw.githubusercontent.com/kkdai/linebot-food-enthusiast/main/img/calc.jpg"
 const CookImg = "https://raw.githubusercontent.com/kkdai/linebot-food-enthusiast/main/img/cooking.png"
 
+// replyTarget: Where the answers of an event are delivered.
+type replyTarget struct {
+	ReplyToken string    // reply token of the event
+	To         string    // user, group or room ID to push to
+	Expire     time.Time // reply token is not used after this
+}
+
+// newReplyTarget: Build the reply target of an event received at t.
+func newReplyTarget(replyToken string, source webhook.SourceInterface, t time.Time) replyTarget {
+	return replyTarget{
+		ReplyToken: replyToken,
+		To:         sourceTarget(source),
+		Expire:     t.Add(ReplyTokenTTL),
+	}
+}
+
+// sourceTarget: Get the push target ID of an event source.
+func sourceTarget(source webhook.SourceInterface) string {
+	switch s := source.(type) {
+	case webhook.UserSource:
+		return s.UserId
+	case webhook.GroupSource:
+		return s.GroupId
+	case webhook.RoomSource:
+		return s.RoomId
+	}
+	return ""
+}
+
 // pushMsg: Push message to LINE server.
 func pushMsg(target, text string) error {
+	return pushMessages(target, &messaging_api.TextMessage{
+		Text: text,
+	})
+}
+
+// pushMessages: Push messages to LINE server.
+func pushMessages(target string, messages ...messaging_api.MessageInterface) error {
 	if _, err := bot.PushMessage(
 		&messaging_api.PushMessageRequest{
-			To: target,
-			Messages: []messaging_api.MessageInterface{
-				&messaging_api.TextMessage{
-					Text: text,
-				},
-			},
+			To:       target,
+			Messages: messages,
 		},
 		"",
 	); err != nil {
@@ -41,25 +77,36 @@ func pushMsg(target, text string) error {
 	return nil
 }
 
-// replyText: Reply text message to LINE server.
-func replyText(replyToken, text string) error {
-	if _, err := bot.ReplyMessage(
-		&messaging_api.ReplyMessageRequest{
-			ReplyToken: replyToken,
-			Messages: []messaging_api.MessageInterface{
-				&messaging_api.TextMessage{
-					Text: text,
-				},
+// replyMessages: Reply messages to LINE server. Once the reply token expired
+// or was rejected, the messages are pushed to the event source instead.
+func replyMessages(t replyTarget, messages ...messaging_api.MessageInterface) error {
+	if t.ReplyToken != "" && time.Now().Before(t.Expire) {
+		_, err := bot.ReplyMessage(
+			&messaging_api.ReplyMessageRequest{
+				ReplyToken: t.ReplyToken,
+				Messages:   messages,
 			},
-		},
-	); err != nil {
-		return err
+		)
+		if err == nil {
+			return nil
+		}
+		log.Println("Reply failed, fallback to push:", err)
 	}
-	return nil
+	if t.To == "" {
+		return fmt.Errorf("no push target for expired reply token")
+	}
+	return pushMessages(t.To, messages...)
+}
+
+// replyText: Reply text message to LINE server.
+func replyText(t replyTarget, text string) error {
+	return replyMessages(t, &messaging_api.TextMessage{
+		Text: text,
+	})
 }
 
 // handleCameraQuickReply: Handle camera quick reply.
-func handleCameraQuickReply(replyToken string) error {
+func handleCameraQuickReply(t replyTarget) error {
 	msg := &messaging_api.TextMessage{
 		Text: "請上傳一張美食照片，開始相關功能吧！",
 		QuickReply: &messaging_api.QuickReply{
@@ -73,15 +120,7 @@ func handleCameraQuickReply(replyToken string) error {
 			},
 		},
 	}
-	if _, err := bot.ReplyMessage(
-		&messaging_api.ReplyMessageRequest{
-			ReplyToken: replyToken,
-			Messages:   []messaging_api.MessageInterface{msg},
-		},
-	); err != nil {
-		return err
-	}
-	return nil
+	return replyMessages(t, msg)
 }
 
 // callbackHandler: Handle callback from LINE server.
@@ -96,194 +135,389 @@ func callbackHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for _, event := range cb.Events {
-		log.Printf("Got event %v", event)
-		switch e := event.(type) {
-		case webhook.MessageEvent:
-			// 取得用戶 ID
-			var uID string
-			switch source := e.Source.(type) {
-			case webhook.UserSource:
-				uID = source.UserId
-			case webhook.GroupSource:
-				uID = source.UserId
-			case webhook.RoomSource:
-				uID = source.UserId
+	// Acknowledge right away, the events are handled by the queue workers.
+	// Take the whole batch or none of it, LINE redelivers all of it.
+	if !events.EnqueueAll(cb.Events) {
+		log.Printf("Event queue full, rejected %d events", len(cb.Events))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleEvent: Handle a single webhook event received at the given time.
+func handleEvent(ctx context.Context, event webhook.EventInterface, received time.Time) {
+	log.Printf("Got event %v", event)
+
+	// Skip the events LINE redelivers after we already handled them.
+	id, delivery := eventMeta(event)
+	if delivery != nil && delivery.IsRedelivery {
+		log.Println("Redelivered event:", id)
+	}
+	if id != "" && dedup.Seen(ctx, id) {
+		log.Println("Skip duplicate event:", id)
+		return
+	}
+
+	switch e := event.(type) {
+	case webhook.MessageEvent:
+		// 取得用戶 ID，群組中的紀錄仍屬於發言的成員
+		src := sourceOf(e.Source)
+		uID := src.UserID
+		log.Println("User ID:", uID)
+		rt := newReplyTarget(e.ReplyToken, e.Source, received)
+
+		// In groups only answer the text messages mentioning the bot.
+		if src.GroupID != "" {
+			message, ok := e.Message.(webhook.TextMessageContent)
+			if !ok || len(botMentions(message)) == 0 {
+				return
 			}
-			log.Println("User ID:", uID)
-			fireDB.SetPath(fmt.Sprintf("%s/%s", DBFoodPath, uID))
+		}
+		if !allowPersonal(src, rt) {
+			return
+		}
+		joinGroup(ctx, src)
+		ctx = withGroup(ctx, src.GroupID)
 
-			switch message := e.Message.(type) {
-			// Handle only on text message
-			case webhook.TextMessageContent:
-				// Handle only on text message
-				answer := gemini.GeminiFunctionCall(message.Text)
-				if err := replyText(e.ReplyToken, answer); err != nil {
+		switch message := e.Message.(type) {
+		// Handle only on text message
+		case webhook.TextMessageContent:
+			text := stripMentions(message)
+			// Undo the last write without asking Gemini, even while a
+			// question of the onboarding is pending.
+			if isUndo(text) {
+				if err := replyText(rt, undoLast(ctx, uID)); err != nil {
 					log.Print(err)
 				}
-
-			// Handle only on Sticker message
-			case webhook.StickerMessageContent:
-				var kw string
-				for _, k := range message.Keywords {
-					kw = kw + "," + k
+				return
+			}
+			// Answer the onboarding questionnaire and the privacy requests
+			// in the personal chat only.
+			if src.GroupID == "" {
+				if isKeyword(text, exportKeywords) {
+					if err := replyText(rt, exportReply(uID)); err != nil {
+						log.Print(err)
+					}
+					return
 				}
-
-				outStickerResult := fmt.Sprintf("收到貼圖訊息: %s, pkg: %s kw: %s  text: %s", message.StickerId, message.PackageId, kw, message.Text)
-				if err := replyText(e.ReplyToken, outStickerResult); err != nil {
-					log.Print(err)
+				if isKeyword(text, deleteKeywords) {
+					answer, qReply := deleteDataReply()
+					if err := replyMessages(rt, &messaging_api.TextMessage{Text: answer, QuickReply: qReply}); err != nil {
+						log.Print(err)
+					}
+					return
+				}
+				if isOnboarding(text) {
+					answer, qReply := startOnboarding(ctx, uID)
+					if err := replyMessages(rt, &messaging_api.TextMessage{Text: answer, QuickReply: qReply}); err != nil {
+						log.Print(err)
+					}
+					return
+				}
+				if answer, qReply, ok := onboard(ctx, uID, text); ok {
+					if err := replyMessages(rt, &messaging_api.TextMessage{Text: answer, QuickReply: qReply}); err != nil {
+						log.Print(err)
+					}
+					return
 				}
+			}
+			// Handle only on text message
+			answer, qReply := GeminiFunctionCall(ctx, uID, text)
+			if err := replyMessages(rt, &messaging_api.TextMessage{
+				Text:       answer,
+				QuickReply: qReply,
+			}); err != nil {
+				log.Print(err)
+			}
 
-			// Handle only image message
-			case webhook.ImageMessageContent:
-				log.Println("Got img msg ID:", message.Id)
+		// Handle only on Sticker message
+		case webhook.StickerMessageContent:
+			var kw string
+			for _, k := range message.Keywords {
+				kw = kw + "," + k
+			}
 
-				//Get image binary from LINE server based on message ID.
-				data, err := GetImageBinary(blob, message.Id)
-				if err != nil {
-					log.Println("Got GetMessageContent err:", err)
-					continue
-				}
+			outStickerResult := fmt.Sprintf("收到貼圖訊息: %s, pkg: %s kw: %s  text: %s", message.StickerId, message.PackageId, kw, message.Text)
+			if err := replyText(rt, outStickerResult); err != nil {
+				log.Print(err)
+			}
 
-				ret, err := gemini.GeminiImage(data, ImagePrompt)
-				if err != nil {
-					ret = "無法辨識影片內容文字，請重新輸入:" + err.Error()
-				}
+		// Handle only image message
+		case webhook.ImageMessageContent:
+			log.Println("Got img msg ID:", message.Id)
 
-				// Prepare QuickReply buttons.
-				qReply := &messaging_api.QuickReply{
-					Items: []messaging_api.QuickReplyItem{
-						{
-							ImageUrl: CalcImg,
-							Action: &messaging_api.PostbackAction{
-								Label:       "calc",
-								Data:        "action=calc&m_id=" + message.Id,
-								DisplayText: "計算卡路里",
-								Text:        "",
-							},
-						}, {
-							ImageUrl: CookImg,
-							Action: &messaging_api.PostbackAction{
-								Label:       "cook",
-								Data:        "action=cook&m_id=" + message.Id,
-								DisplayText: "建議食譜",
-								Text:        "",
-							},
-						},
-					},
-				}
+			//Get image binary from LINE server and keep it for the postbacks.
+			data, err := getImage(blob, message.Id)
+			if err != nil {
+				log.Println("Got GetMessageContent err:", err)
+				return
+			}
 
-				// Determine the push msg target.
-				if _, err := bot.ReplyMessage(
-					&messaging_api.ReplyMessageRequest{
-						ReplyToken: e.ReplyToken,
-						Messages: []messaging_api.MessageInterface{
-							&messaging_api.TextMessage{
-								Text:       ret,
-								QuickReply: qReply,
-							},
+			ret, err := gemini.GeminiImage(ctx, data, ImagePrompt)
+			if err != nil {
+				ret = friendlyError(err)
+			} else if err := SaveAnalysis(ctx, uID, message.Id, ret); err != nil {
+				// Keep the description as context of the calc and cook postbacks.
+				log.Print(err)
+			}
+
+			// Prepare QuickReply buttons.
+			qReply := &messaging_api.QuickReply{
+				Items: []messaging_api.QuickReplyItem{
+					{
+						ImageUrl: CalcImg,
+						Action: &messaging_api.PostbackAction{
+							Label:       "calc",
+							Data:        "action=calc&m_id=" + message.Id,
+							DisplayText: "計算卡路里",
+							Text:        "",
+						},
+					}, {
+						ImageUrl: CookImg,
+						Action: &messaging_api.PostbackAction{
+							Label:       "cook",
+							Data:        "action=cook&m_id=" + message.Id,
+							DisplayText: "建議食譜",
+							Text:        "",
 						},
 					},
-				); err != nil {
-					log.Print(err)
-				}
+				},
+			}
 
-			// Handle only video message
-			case webhook.VideoMessageContent:
-				log.Println("Got video msg ID:", message.Id)
+			card := foodCard{Title: "美食分析", Note: ret}
+			if err := replyMessages(rt, cardMessage(card, qReply)); err != nil {
+				log.Print(err)
+			}
+
+		// Handle only video message
+		case webhook.VideoMessageContent:
+			log.Println("Got video msg ID:", message.Id)
+
+		default:
+			log.Printf("Unknown message: %v", message)
+		}
+	case webhook.PostbackEvent:
+		// Using urls value to parse event.Postback.Data strings.
+		ret, err := url.ParseQuery(e.Postback.Data)
+		if err != nil {
+			log.Print("action parse err:", err, " dat=", e.Postback.Data)
+			return
+		}
 
-			default:
-				log.Printf("Unknown message: %v", message)
+		log.Println("Action:", ret["action"])
+		log.Println("Calc calories m_id:", ret["m_id"])
+
+		// 取得用戶 ID
+		src := sourceOf(e.Source)
+		uID := src.UserID
+		rt := newReplyTarget(e.ReplyToken, e.Source, received)
+		if !allowPersonal(src, rt) {
+			return
+		}
+		ctx = withGroup(ctx, src.GroupID)
+
+		// Handle only on Postback message
+		if ret["action"][0] == "calc" {
+			// Determine the push msg target.
+			processImage(ctx, uID, rt, ret["m_id"][0], CalcPrompt, ret["action"][0], blob) // for calcCalories
+		} else if ret["action"][0] == "cook" {
+			// Determine the push msg target.
+			processImage(ctx, uID, rt, ret["m_id"][0], CookPrompt, ret["action"][0], blob) // for searchCooking
+		} else if ret["action"][0] == "delete" {
+			if err := replyText(rt, confirmDelete(ctx, uID, ret.Get("key"))); err != nil {
+				log.Print(err)
+			}
+		} else if ret["action"][0] == "undo" {
+			if err := replyText(rt, undoLast(ctx, uID)); err != nil {
+				log.Print(err)
 			}
-		case webhook.PostbackEvent:
-			// Using urls value to parse event.Postback.Data strings.
-			ret, err := url.ParseQuery(e.Postback.Data)
+		} else if ret["action"][0] == "purge" {
+			if err := replyText(rt, confirmDeleteData(ctx, uID)); err != nil {
+				log.Print(err)
+			}
+		} else if ret["action"][0] == "cancel" {
+			if err := replyText(rt, "好的，已取消。"); err != nil {
+				log.Print(err)
+			}
+		} else if ret["action"][0] == "meal" {
+			meal := ret.Get("meal")
+			n, err := setMessageMeal(ctx, uID, ret.Get("m_id"), meal)
+			answer := fmt.Sprintf("已將這餐的 %d 項食物標記為%s。", n, mealNames[meal])
 			if err != nil {
-				log.Print("action parse err:", err, " dat=", e.Postback.Data)
-				continue
+				log.Print(err)
+				answer = "無法更新這餐的類型，請稍後再試。"
 			}
-
-			log.Println("Action:", ret["action"])
-			log.Println("Calc calories m_id:", ret["m_id"])
-
-			// 取得用戶 ID
-			var target string
-			switch source := e.Source.(type) {
-			case webhook.UserSource:
-				target = source.UserId
-			case webhook.GroupSource:
-				target = source.UserId
-			case webhook.RoomSource:
-				target = source.UserId
+			if err := replyText(rt, answer); err != nil {
+				log.Print(err)
+			}
+		}
+	case webhook.FollowEvent:
+		log.Printf("message: Got followed event")
+		src := sourceOf(e.Source)
+		if src.Anonymous() {
+			return
+		}
+		// Keep the data of a user coming back within the grace period.
+		if err := markActive(ctx, src.UserID); err != nil {
+			log.Print(err)
+		}
+		// Ask for the profile to recommend a daily calorie target, unless
+		// a returning user already filled it in.
+		var answer string
+		var qReply *messaging_api.QuickReply
+		if p, err := GetProfile(ctx, src.UserID); err == nil && p.Age != 0 {
+			answer = "歡迎回來！輸入「設定個人資料」可以重新填寫你的資料。"
+		} else {
+			answer, qReply = startOnboarding(ctx, src.UserID)
+		}
+		rt := newReplyTarget(e.ReplyToken, e.Source, received)
+		if err := replyMessages(rt, &messaging_api.TextMessage{Text: answer, QuickReply: qReply}); err != nil {
+			log.Print(err)
+		}
+	case webhook.UnfollowEvent:
+		// The user blocked the bot, delete the data after the grace period.
+		src := sourceOf(e.Source)
+		log.Println("Unfollowed by:", src.UserID)
+		if !src.Anonymous() {
+			if err := markInactive(ctx, src.UserID, received); err != nil {
+				log.Print(err)
 			}
-			fireDB.SetPath(fmt.Sprintf("%s/%s", DBFoodPath, target))
-
-			// Handle only on Postback message
-			if ret["action"][0] == "calc" {
-				// Determine the push msg target.
-				processImage(e.ReplyToken, ret["m_id"][0], CalcPrompt, ret["action"][0], blob) // for calcCalories
-			} else if ret["action"][0] == "cook" {
-				// Determine the push msg target.
-				processImage(e.ReplyToken, ret["m_id"][0], CookImg, ret["action"][0], blob) // for searchCooking
+		}
+	case webhook.LeaveEvent:
+		// The bot left the group, forget its members.
+		src := sourceOf(e.Source)
+		log.Println("Left group:", src.GroupID)
+		if src.GroupID != "" {
+			if err := foodDB.DeleteDB(ctx, fmt.Sprintf("%s/%s", DBGroupPath, src.GroupID)); err != nil {
+				log.Print(err)
 			}
-		case webhook.FollowEvent:
-			log.Printf("message: Got followed event")
-		case webhook.BeaconEvent:
-			log.Printf("Got beacon: " + e.Beacon.Hwid)
 		}
+	case webhook.BeaconEvent:
+		log.Printf("Got beacon: " + e.Beacon.Hwid)
 	}
 }
 
-// ProcessImage: Process an image and reply with a text.
-func processImage(target, m_id, prompt, proType string, blob *messaging_api.MessagingApiBlobAPI) {
-	// Get image data
-	data, err := GetImageBinary(blob, m_id)
+// ProcessImage: Process an image for the user uID and reply with a text.
+func processImage(ctx context.Context, uID string, target replyTarget, m_id, prompt, proType string, blob *messaging_api.MessagingApiBlobAPI) {
+	// Reuse the description the user already saw when the image was sent.
+	description, err := GetAnalysis(ctx, uID, m_id)
 	if err != nil {
-		log.Printf("Got GetMessageContent err: %v", err)
+		log.Print(err)
+	}
+
+	// A recipe only needs the dishes, so skip sending the image again.
+	if proType != "calc" && description != "" {
+		responseMsg, err := gemini.GeminiChatComplete(ctx, fmt.Sprintf("%s\n\n%s", CookTextPrompt, description))
+		if err != nil {
+			responseMsg = friendlyError(err)
+		}
+		if err := replyText(target, responseMsg); err != nil {
+			log.Print(err)
+		}
 		return
 	}
 
-	// Chat with Image
-	responseMsg, err := gemini.GeminiImage(data, prompt)
+	// Get image data, cached when the image was sent.
+	data, err := getImage(blob, m_id)
 	if err != nil {
-		log.Printf("Got %s err: %v", proType, err)
+		log.Printf("Got GetMessageContent err: %v", err)
+		if err := replyText(target, "找不到這張照片了，請重新上傳一次。"); err != nil {
+			log.Print(err)
+		}
 		return
 	}
+	prompt = withAnalysis(prompt, description)
 
-	if proType == "calc" {
-		jsonData := removeFirstAndLastLine(responseMsg)
-		log.Println("Got JSON:", jsonData)
-		// unmarshal json
-		var food Food
-		if err := json.Unmarshal([]byte(jsonData), &food); err != nil {
+	if proType != "calc" {
+		// Chat with Image
+		responseMsg, err := gemini.GeminiImage(ctx, data, prompt)
+		if err != nil {
+			log.Printf("Got %s err: %v", proType, err)
+			responseMsg = friendlyError(err)
+		}
+		if err := replyText(target, responseMsg); err != nil {
 			log.Print(err)
 		}
+		return
+	}
 
-		// Add time
-		food.Date = GetLocalTimeString()
+	// Estimate the calories of every dish in the image.
+	answer, err := gemini.GeminiImageJSON(ctx, data, prompt, foodListSchema)
+	if err != nil {
+		log.Printf("Got %s err: %v", proType, err)
+		if err := replyText(target, friendlyError(err)); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+	log.Println("Got JSON:", answer)
+	foods, err := parseFoods(answer)
+	if err != nil {
+		log.Print(err)
+		if err := replyText(target, "無法估算這張照片的卡路里，請換一張照片試試。"); err != nil {
+			log.Print(err)
+		}
+		return
+	}
 
-		// Print all food data before insert DB
-		fmt.Println("Insert food data:", food)
+	profile, err := GetProfile(ctx, uID)
+	if err != nil {
+		log.Print(err)
+	}
 
-		// Insert data to firebase
-		if err := fireDB.InsertDB(food); err != nil {
+	// Insert every dish to the user's records
+	now := time.Now().In(userLocation(profile))
+	meal := inferMeal(now)
+	var changes []journalChange
+	var names []string
+	for i := range foods {
+		stampFood(&foods[i], now)
+		foods[i].Meal = meal
+		foods[i].MessageID = m_id
+		foods[i].GroupID = groupOf(ctx)
+		fmt.Println("Insert food data:", foods[i])
+		key, err := InsertFood(ctx, uID, foods[i])
+		if err != nil {
 			log.Print(err)
+			continue
 		}
-		prompt := fmt.Sprintf("總共吃了以下食物 %s, 請幫我總結並且計算總卡路里數。 ", jsonData)
-		responseMsg = gemini.GeminiChatComplete(prompt)
+		changes = append(changes, journalChange{Op: OpInsert, Key: key, Day: foodDay(foods[i])})
+		names = append(names, foods[i].Name)
 	}
+	journal(ctx, uID, "記錄 "+strings.Join(names, "、"), changes...)
 
-	// Determine the push msg target.
-	if _, err := bot.ReplyMessage(
-		&messaging_api.ReplyMessageRequest{
-			ReplyToken: target,
-			Messages: []messaging_api.MessageInterface{
-				&messaging_api.TextMessage{
-					Text: responseMsg,
-				},
-			},
-		},
-	); err != nil {
+	jsonData, err := json.Marshal(foods)
+	if err != nil {
+		log.Print(err)
+	}
+	all, err := visibleFoods(ctx, uID)
+	if err != nil {
+		log.Print(err)
+	}
+	total := dailyTotal(all, foodDay(foods[0]))
+	summary := fmt.Sprintf("總共吃了以下食物 %s, 請用兩三句話簡短總結這一餐的營養，不需要重新計算卡路里。", jsonData)
+	// The card is still worth sending without the note.
+	note, err := gemini.GeminiChatComplete(ctx, summary)
+	if err != nil {
+		log.Print(err)
+	}
+
+	card := foodCard{
+		Title: "卡路里估算・" + mealNames[meal],
+		Foods: foods,
+		Total: total,
+		Note:  note,
+	}
+	// The total of a group chat only counts its entries, keep the goal to
+	// the personal chat.
+	if groupOf(ctx) == "" {
+		card.Goal = profile.CalorieGoal
+	}
+	// Let the user correct the guessed meal type, or undo a duplicate.
+	qReply := mealQuickReply(m_id)
+	qReply.Items = append(qReply.Items, undoQuickReplyItem())
+	if err := replyMessages(target, cardMessage(card, qReply)); err != nil {
 		log.Print(err)
 	}
 }
@@ -294,11 +528,12 @@ func GetImageBinary(blob *messaging_api.MessagingApiBlobAPI, messageID string) (
 	content, err := blob.GetMessageContent(messageID)
 	if err != nil {
 		log.Println("Got GetMessageContent err:", err)
+		return nil, err
 	}
 	defer content.Body.Close()
 	data, err := io.ReadAll(content.Body)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	return data, nil
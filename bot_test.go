@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+// testImage is the content the fake LINE server returns for every message.
+var testImage = []byte("\x89PNG fake image")
+
+// sentMessage is a message the bot replied or pushed to the fake LINE server.
+type sentMessage struct {
+	Type       string `json:"type"`
+	Text       string `json:"text"`
+	AltText    string `json:"altText"`
+	QuickReply struct {
+		Items []struct {
+			Action struct {
+				Data string `json:"data"`
+				URI  string `json:"uri"`
+			} `json:"action"`
+		} `json:"items"`
+	} `json:"quickReply"`
+}
+
+// hasPostback reports whether the message offers a quick reply button
+// posting back data.
+func (m sentMessage) hasPostback(data string) bool {
+	for _, item := range m.QuickReply.Items {
+		if item.Action.Data == data {
+			return true
+		}
+	}
+	return false
+}
+
+// lineRequest is a reply or push request received by the fake LINE server.
+type lineRequest struct {
+	Path       string
+	ReplyToken string        `json:"replyToken"`
+	To         string        `json:"to"`
+	Messages   []sentMessage `json:"messages"`
+}
+
+// fakeLINE is a LINE Messaging API server recording what the bot sends.
+type fakeLINE struct {
+	mu   sync.Mutex
+	sent []lineRequest
+}
+
+// useFakeLINE points bot and blob at a fake LINE server for the test.
+func useFakeLINE(t *testing.T) *fakeLINE {
+	t.Helper()
+	f := &fakeLINE{}
+	srv := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(srv.Close)
+
+	prevBot, prevBlob, prevImages := bot, blob, images
+	var err error
+	if bot, err = messaging_api.NewMessagingApiAPI("token", messaging_api.WithEndpoint(srv.URL)); err != nil {
+		t.Fatal(err)
+	}
+	if blob, err = messaging_api.NewMessagingApiBlobAPI("token", messaging_api.WithBlobEndpoint(srv.URL)); err != nil {
+		t.Fatal(err)
+	}
+	images = NewImageCache(1<<20, time.Hour, "")
+	t.Cleanup(func() {
+		bot, blob, images = prevBot, prevBlob, prevImages
+	})
+	return f
+}
+
+func (f *fakeLINE) serve(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/v2/bot/message/reply" || r.URL.Path == "/v2/bot/message/push":
+		req := lineRequest{Path: r.URL.Path}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.sent = append(f.sent, req)
+		f.mu.Unlock()
+		w.Write([]byte("{}"))
+	case strings.HasSuffix(r.URL.Path, "/content"):
+		w.Write(testImage)
+	case strings.Contains(r.URL.Path, "/member/"):
+		w.Write([]byte(`{"displayName":"Alice"}`))
+	default:
+		w.Write([]byte("{}"))
+	}
+}
+
+// Sent returns the requests received so far.
+func (f *fakeLINE) Sent() []lineRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]lineRequest(nil), f.sent...)
+}
+
+// lastMessage returns the last message sent, failing the test if none was.
+func (f *fakeLINE) lastMessage(t *testing.T) sentMessage {
+	t.Helper()
+	sent := f.Sent()
+	if len(sent) == 0 || len(sent[len(sent)-1].Messages) == 0 {
+		t.Fatal("no message sent")
+	}
+	msgs := sent[len(sent)-1].Messages
+	return msgs[len(msgs)-1]
+}
+
+// useFakeLLM makes gemini a FakeLLM for the test.
+func useFakeLLM(t *testing.T) *FakeLLM {
+	t.Helper()
+	f := NewFakeLLM()
+	prev := gemini
+	gemini = f
+	t.Cleanup(func() { gemini = prev })
+	return f
+}
+
+// textEvent is a text message sent by the user in the personal chat.
+func textEvent(uID, text string) webhook.MessageEvent {
+	return webhook.MessageEvent{
+		ReplyToken: "reply-" + uID,
+		Source:     webhook.UserSource{UserId: uID},
+		Message:    webhook.TextMessageContent{Id: "t1", Text: text},
+	}
+}
+
+// imageEvent is an image sent by the user in the personal chat.
+func imageEvent(uID, messageID string) webhook.MessageEvent {
+	return webhook.MessageEvent{
+		ReplyToken: "reply-" + uID,
+		Source:     webhook.UserSource{UserId: uID},
+		Message:    webhook.ImageMessageContent{Id: messageID},
+	}
+}
+
+func TestHandleTextRecordsCalorie(t *testing.T) {
+	useTestStore(t)
+	line := useFakeLINE(t)
+	llm := useFakeLLM(t)
+	ctx := context.Background()
+	uID := "Ualice"
+
+	llm.PushFunctionCall("recordCalorie", map[string]any{"foodItem": "漢堡", "calories": 550.0}).
+		PushText("已記錄漢堡 550 大卡。")
+	handleEvent(ctx, textEvent(uID, "我吃了漢堡"), time.Now())
+
+	foods, err := GetFoods(ctx, uID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(foods) != 1 {
+		t.Fatalf("stored %d entries, want 1", len(foods))
+	}
+	for _, f := range foods {
+		if f.Name != "漢堡" || f.Calories != 550 {
+			t.Errorf("stored %+v, want 漢堡 550", f)
+		}
+	}
+
+	calls := llm.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("made %d model calls, want 2", len(calls))
+	}
+	if text, _ := calls[0].Parts[0].(genai.Text); !strings.HasPrefix(string(text), "我吃了漢堡") {
+		t.Errorf("sent %v to the model, want the user text", calls[0].Parts)
+	}
+	if resp, ok := calls[1].Parts[0].(genai.FunctionResponse); !ok || resp.Name != "recordCalorie" || resp.Response["status"] != "Success" {
+		t.Errorf("sent %v back to the model, want the recordCalorie result", calls[1].Parts)
+	}
+
+	sent := line.Sent()
+	if len(sent) != 1 || sent[0].Path != "/v2/bot/message/reply" || sent[0].ReplyToken != "reply-"+uID {
+		t.Fatalf("sent %+v, want a single reply", sent)
+	}
+	msg := line.lastMessage(t)
+	if !strings.HasPrefix(msg.Text, "已記錄漢堡 550 大卡。") {
+		t.Errorf("replied %q", msg.Text)
+	}
+	// A recorded entry can be undone from the reply.
+	if !msg.hasPostback("action=undo") {
+		t.Errorf("reply has no undo quick reply: %+v", msg.QuickReply)
+	}
+}
+
+func TestHandleTextModelError(t *testing.T) {
+	useTestStore(t)
+	line := useFakeLINE(t)
+	llm := useFakeLLM(t)
+	ctx := context.Background()
+
+	llm.PushError(errBusy)
+	handleEvent(ctx, textEvent("Ualice", "今天吃了什麼"), time.Now())
+
+	if msg := line.lastMessage(t); msg.Text != BusyReply {
+		t.Errorf("replied %q, want %q", msg.Text, BusyReply)
+	}
+	// A failed exchange is not remembered.
+	h, err := GetChatHistory(ctx, "Ualice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Turns) != 0 {
+		t.Errorf("remembered %d turns of a failed exchange", len(h.Turns))
+	}
+}
+
+func TestHandleImageThenCalc(t *testing.T) {
+	useTestStore(t)
+	line := useFakeLINE(t)
+	llm := useFakeLLM(t)
+	ctx := context.Background()
+	uID := "Ualice"
+
+	// The image is described first, with buttons to estimate its calories.
+	llm.PushText("一碗牛肉麵")
+	handleEvent(ctx, imageEvent(uID, "m1"), time.Now())
+
+	msg := line.lastMessage(t)
+	if msg.Type != "flex" || !msg.hasPostback("action=calc&m_id=m1") {
+		t.Fatalf("sent %+v, want the analysis card with a calc button", msg)
+	}
+	if got, err := GetAnalysis(ctx, uID, "m1"); err != nil || got != "一碗牛肉麵" {
+		t.Errorf("saved analysis %q, %v", got, err)
+	}
+
+	// The calc postback estimates the dishes and records them.
+	llm.PushJSON([]map[string]any{{"name": "牛肉麵", "calories": 700}}).
+		PushText("蛋白質充足。")
+	handleEvent(ctx, webhook.PostbackEvent{
+		ReplyToken: "reply-calc",
+		Source:     webhook.UserSource{UserId: uID},
+		Postback:   &webhook.PostbackContent{Data: "action=calc&m_id=m1"},
+	}, time.Now())
+
+	calls := llm.Calls()
+	if len(calls) != 3 || calls[1].Method != "GeminiImageJSON" {
+		t.Fatalf("model calls %+v, want the image estimated", calls)
+	}
+	if blob, _ := calls[1].Parts[0].(genai.Blob); string(blob.Data) != string(testImage) {
+		t.Error("estimated another image than the one sent")
+	}
+	foods, err := GetFoods(ctx, uID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(foods) != 1 {
+		t.Fatalf("stored %d entries, want 1", len(foods))
+	}
+	for _, f := range foods {
+		if f.Name != "牛肉麵" || f.Calories != 700 || f.MessageID != "m1" {
+			t.Errorf("stored %+v", f)
+		}
+	}
+	if msg := line.lastMessage(t); msg.Type != "flex" || !strings.HasPrefix(msg.AltText, "卡路里估算") || !msg.hasPostback("action=undo") {
+		t.Errorf("sent %+v, want the calorie card", msg)
+	}
+}
+
+func TestHandleImageDownloadFails(t *testing.T) {
+	useTestStore(t)
+	useFakeLLM(t)
+	line := useFakeLINE(t)
+	blobSrv := httptest.NewServer(http.NotFoundHandler())
+	defer blobSrv.Close()
+	var err error
+	if blob, err = messaging_api.NewMessagingApiBlobAPI("token", messaging_api.WithBlobEndpoint(blobSrv.URL)); err != nil {
+		t.Fatal(err)
+	}
+
+	handleEvent(context.Background(), webhook.PostbackEvent{
+		ReplyToken: "reply-calc",
+		Source:     webhook.UserSource{UserId: "Ualice"},
+		Postback:   &webhook.PostbackContent{Data: "action=calc&m_id=gone"},
+	}, time.Now())
+
+	if msg := line.lastMessage(t); msg.Text != "找不到這張照片了，請重新上傳一次。" {
+		t.Errorf("replied %q", msg.Text)
+	}
+}
+
+func TestReplyFallsBackToPush(t *testing.T) {
+	line := useFakeLINE(t)
+	rt := replyTarget{ReplyToken: "old", To: "Ualice", Expire: time.Now().Add(-time.Second)}
+	if err := replyText(rt, "晚了一點"); err != nil {
+		t.Fatal(err)
+	}
+	sent := line.Sent()
+	if len(sent) != 1 || sent[0].Path != "/v2/bot/message/push" || sent[0].To != "Ualice" {
+		t.Errorf("sent %+v, want a push to the user", sent)
+	}
+
+	rt.To = ""
+	if err := replyText(rt, "晚了一點"); err == nil {
+		t.Error("expired reply without a push target succeeded")
+	}
+}
+
+func TestHandleTextRecordsSeveralFoods(t *testing.T) {
+	useTestStore(t)
+	line := useFakeLINE(t)
+	llm := useFakeLLM(t)
+	ctx := context.Background()
+	uID := "Ualice"
+
+	llm.PushFunctionCalls(
+		genai.FunctionCall{Name: "recordCalorie", Args: map[string]any{"foodItem": "漢堡", "calories": 550.0}},
+		genai.FunctionCall{Name: "recordCalorie", Args: map[string]any{"foodItem": "薯條", "calories": 320.0}},
+	).PushText("已記錄漢堡和薯條。")
+	handleEvent(ctx, textEvent(uID, "I had a burger and fries"), time.Now())
+
+	foods, err := GetFoods(ctx, uID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(foods) != 2 {
+		t.Fatalf("stored %d entries, want 2", len(foods))
+	}
+	// Both results go back to the model in one message.
+	calls := llm.Calls()
+	if len(calls) != 2 || len(calls[1].Parts) != 2 {
+		t.Fatalf("model calls %+v, want both results at once", calls)
+	}
+	if msg := line.lastMessage(t); !strings.HasPrefix(msg.Text, "已記錄漢堡和薯條。") || strings.Count(msg.Text, "📊") != 1 {
+		t.Errorf("replied %q, want the answer and a single budget", msg.Text)
+	}
+
+	// One undo removes the whole message.
+	keys, _, err := journalKeys(ctx, uID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("journaled %d actions, want 1", len(keys))
+	}
+	handleEvent(ctx, textEvent(uID, "復原"), time.Now())
+	if foods, _ := GetFoods(ctx, uID); len(foods) != 0 {
+		t.Errorf("kept %d entries after undo", len(foods))
+	}
+	if msg := line.lastMessage(t); !strings.Contains(msg.Text, "漢堡") || !strings.Contains(msg.Text, "薯條") {
+		t.Errorf("undo replied %q", msg.Text)
+	}
+}
+
+func TestHandleTextStopsAtMaxToolSteps(t *testing.T) {
+	useTestStore(t)
+	line := useFakeLINE(t)
+	llm := useFakeLLM(t)
+	ctx := context.Background()
+
+	// The model keeps asking for tools.
+	for i := 0; i <= MaxToolSteps+1; i++ {
+		llm.PushFunctionCall("getSummary", map[string]any{"period": PeriodDay})
+	}
+	handleEvent(ctx, textEvent("Ualice", "今天吃了多少"), time.Now())
+
+	if calls := llm.Calls(); len(calls) != MaxToolSteps+1 {
+		t.Errorf("made %d model calls, want %d", len(calls), MaxToolSteps+1)
+	}
+	if msg := line.lastMessage(t); !strings.HasPrefix(msg.Text, "這個要求的步驟太多了") {
+		t.Errorf("replied %q", msg.Text)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// foodListSchema is the response schema of the calorie estimation: one item
+// per dish found in the photo.
+var foodListSchema = &genai.Schema{
+	Type: genai.TypeArray,
+	Items: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: withNutrients(map[string]*genai.Schema{
+			"name": {
+				Type:        genai.TypeString,
+				Description: "The name of the dish",
+			},
+			"portion": {
+				Type:        genai.TypeString,
+				Description: "The estimated portion, e.g. 1 bowl or 200g",
+			},
+			"calories": {
+				Type:        genai.TypeInteger,
+				Description: "The estimated calories in kcal",
+			},
+			"confidence": {
+				Type:        genai.TypeNumber,
+				Description: "Confidence of the estimation from 0 to 1",
+			},
+		}),
+		Required: []string{"name", "calories"},
+	},
+}
+
+// errNoFood is returned when no food item can be read from an answer.
+var errNoFood = errors.New("no food item in answer")
+
+// numberRegex matches the first number of a string such as "350 kcal".
+var numberRegex = regexp.MustCompile(`-?\d+(\.\d+)?`)
+
+// parseFoods: Parse the calorie estimation answer into food items. Besides
+// the schema's JSON list it accepts markdown fences, prose around the JSON,
+// a single object or an object wrapping the list.
+func parseFoods(answer string) ([]Food, error) {
+	start := strings.IndexAny(answer, "[{")
+	if start < 0 {
+		return nil, errNoFood
+	}
+
+	var v interface{}
+	if err := json.NewDecoder(bytes.NewBufferString(answer[start:])).Decode(&v); err != nil {
+		return nil, fmt.Errorf("parse food json: %w", err)
+	}
+
+	var foods []Food
+	for _, item := range foodItems(v) {
+		if food, ok := toFood(item); ok {
+			foods = append(foods, food)
+		}
+	}
+	if len(foods) == 0 {
+		return nil, errNoFood
+	}
+	return foods, nil
+}
+
+// foodItems: Get the list of item objects out of a decoded answer.
+func foodItems(v interface{}) []map[string]interface{} {
+	var items []map[string]interface{}
+	switch t := v.(type) {
+	case []interface{}:
+		for _, e := range t {
+			if m, ok := e.(map[string]interface{}); ok {
+				items = append(items, m)
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range []string{"foods", "food", "items", "dishes"} {
+			if list, ok := t[key].([]interface{}); ok {
+				return foodItems(list)
+			}
+			if m, ok := t[key].(map[string]interface{}); ok {
+				return []map[string]interface{}{m}
+			}
+		}
+		items = append(items, t)
+	}
+	return items
+}
+
+// toFood: Convert an item object into a Food, reporting whether it had a name.
+func toFood(item map[string]interface{}) (Food, bool) {
+	var food Food
+	for _, key := range []string{"name", "foodItem", "food"} {
+		if name, ok := item[key].(string); ok && name != "" {
+			food.Name = name
+			break
+		}
+	}
+	if food.Name == "" {
+		return food, false
+	}
+	food.Portion, _ = item["portion"].(string)
+	food.Calories = int(toNumber(item["calories"]))
+	food.Confidence = toNumber(item["confidence"])
+	food.Nutrients = toNutrients(item)
+	return food, true
+}
+
+// toNumber: Read a JSON number, or the first number in a JSON string.
+func toNumber(v interface{}) float64 {
+	switch t := v.(type) {
+	case float64:
+		return t
+	case string:
+		f, _ := strconv.ParseFloat(numberRegex.FindString(t), 64)
+		return f
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseFoods(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		answer string
+		want   string // name:calories of each food
+		err    error
+	}{
+		{"bare list", `[{"name":"漢堡","calories":550},{"name":"薯條","calories":320}]`, "漢堡:550,薯條:320", nil},
+		{"json fence", "```json\n[{\"name\":\"漢堡\",\"calories\":550}]\n```", "漢堡:550", nil},
+		{"prose around", "這是估算結果: [{\"name\":\"漢堡\",\"calories\":550}] 請參考。", "漢堡:550", nil},
+		{"single object", `{"name":"牛肉麵","calories":700}`, "牛肉麵:700", nil},
+		{"wrapped list", `{"foods":[{"foodItem":"沙拉","calories":150},{"food":"湯","calories":80}]}`, "沙拉:150,湯:80", nil},
+		{"string calories", `[{"name":"蛋糕","calories":"350 kcal","protein":"5g"}]`, "蛋糕:350", nil},
+		{"unnamed items skipped", `[{"calories":100},{"name":"茶","calories":0}]`, "茶:0", nil},
+		{"no json", "這張照片看不出是什麼食物。", "", errNoFood},
+		{"no food", `{"message":"not food"}`, "", errNoFood},
+		{"empty list", `[]`, "", errNoFood},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			foods, err := parseFoods(tc.answer)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("got %v, %v, want %v", foods, err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, f := range foods {
+				got = append(got, f.Name+":"+strconv.Itoa(f.Calories))
+			}
+			if strings.Join(got, ",") != tc.want {
+				t.Errorf("got %v, want %s", got, tc.want)
+			}
+		})
+	}
+
+	foods, err := parseFoods(`[{"name":"蛋糕","calories":"350 kcal","protein":"5g","sodium":120}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := foods[0].Nutrients; n.Protein != 5 || n.Sodium != 120 {
+		t.Errorf("nutrients %+v, want protein 5 and sodium 120", n)
+	}
+
+	if _, err := parseFoods(`[{"name":"漢堡",`); err == nil || errors.Is(err, errNoFood) {
+		t.Errorf("truncated json: got %v, want a parse error", err)
+	}
+}
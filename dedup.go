@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+// DBEventPath is the path of the processed webhook event IDs in the database
+const DBEventPath = "events"
+
+// DefaultEventTTL is how long a processed webhook event ID is remembered.
+const DefaultEventTTL = 24 * time.Hour
+
+// processedEvent is the persisted record of a handled webhook event.
+type processedEvent struct {
+	Time int64 `json:"time"`
+}
+
+// EventDedup remembers the webhookEventId of processed events, in memory and
+// in the storage backend, so LINE redeliveries are not handled twice.
+type EventDedup struct {
+	ttl   time.Duration
+	store FoodStore
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// dedup is the idempotency store used by handleEvent.
+var dedup *EventDedup
+
+// NewEventDedup creates an idempotency store keeping event IDs for ttl.
+// store may be nil to keep them in memory only.
+func NewEventDedup(store FoodStore, ttl time.Duration) *EventDedup {
+	if ttl <= 0 {
+		ttl = DefaultEventTTL
+	}
+	return &EventDedup{
+		ttl:   ttl,
+		store: store,
+		seen:  map[string]time.Time{},
+	}
+}
+
+// Seen reports whether the event was already processed, and marks it as
+// processed otherwise.
+func (d *EventDedup) Seen(ctx context.Context, id string) bool {
+	now := time.Now()
+
+	d.mu.Lock()
+	if t, ok := d.seen[id]; ok && now.Sub(t) < d.ttl {
+		d.mu.Unlock()
+		return true
+	}
+	d.seen[id] = now
+	d.mu.Unlock()
+
+	if d.store == nil {
+		return false
+	}
+	path := fmt.Sprintf("%s/%s", DBEventPath, id)
+	var rec processedEvent
+	if err := d.store.GetFromDB(ctx, path, &rec); err != nil {
+		log.Println("Dedup read err:", err)
+	} else if rec.Time != 0 && now.Sub(time.Unix(rec.Time, 0)) < d.ttl {
+		return true
+	}
+	if err := d.store.SetDB(ctx, path, processedEvent{Time: now.Unix()}); err != nil {
+		log.Println("Dedup save err:", err)
+	}
+	return false
+}
+
+// Sweep drops the expired event IDs from memory and storage.
+func (d *EventDedup) Sweep(ctx context.Context) {
+	now := time.Now()
+
+	d.mu.Lock()
+	for id, t := range d.seen {
+		if now.Sub(t) >= d.ttl {
+			delete(d.seen, id)
+		}
+	}
+	d.mu.Unlock()
+
+	if d.store == nil {
+		return
+	}
+	var recs map[string]processedEvent
+	if err := d.store.GetFromDB(ctx, DBEventPath, &recs); err != nil {
+		log.Println("Dedup sweep err:", err)
+		return
+	}
+	for id, rec := range recs {
+		if now.Sub(time.Unix(rec.Time, 0)) < d.ttl {
+			continue
+		}
+		if err := d.store.DeleteDB(ctx, fmt.Sprintf("%s/%s", DBEventPath, id)); err != nil {
+			log.Println("Dedup sweep err:", err)
+		}
+	}
+}
+
+// SweepEvery runs Sweep periodically in the background.
+func (d *EventDedup) SweepEvery(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			d.Sweep(context.Background())
+		}
+	}()
+}
+
+// eventMeta: Get the webhook event ID and delivery context of an event.
+func eventMeta(event webhook.EventInterface) (string, *webhook.DeliveryContext) {
+	switch e := event.(type) {
+	case webhook.MessageEvent:
+		return e.WebhookEventId, e.DeliveryContext
+	case webhook.PostbackEvent:
+		return e.WebhookEventId, e.DeliveryContext
+	case webhook.FollowEvent:
+		return e.WebhookEventId, e.DeliveryContext
+	case webhook.UnfollowEvent:
+		return e.WebhookEventId, e.DeliveryContext
+	case webhook.JoinEvent:
+		return e.WebhookEventId, e.DeliveryContext
+	case webhook.LeaveEvent:
+		return e.WebhookEventId, e.DeliveryContext
+	case webhook.BeaconEvent:
+		return e.WebhookEventId, e.DeliveryContext
+	}
+	return "", nil
+}
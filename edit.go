@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// DeleteFood removes the food record with the given key.
+func DeleteFood(ctx context.Context, uID, key string) error {
+	return foodDB.DeleteDB(ctx, fmt.Sprintf("%s/%s", userFoodPath(uID), key))
+}
+
+// findFood: Find the entry a user refers to, by its key or else the latest
+// entry whose name matches on the given day.
+func findFood(foods map[string]Food, key, name, date string) (string, Food, bool) {
+	if f, ok := foods[key]; ok && key != "" {
+		return key, f, true
+	}
+
+	name = strings.ToLower(strings.TrimSpace(name))
+	var found string
+	var latest time.Time
+	for k, f := range foods {
+		fn := strings.ToLower(f.Name)
+		if name != "" && !strings.Contains(fn, name) && !strings.Contains(name, fn) {
+			continue
+		}
+		if date != "" && foodDay(f) != date {
+			continue
+		}
+		t, _ := foodTime(f, time.UTC)
+		if found == "" || t.After(latest) {
+			found, latest = k, t
+		}
+	}
+	if found == "" {
+		return "", Food{}, false
+	}
+	return found, foods[found], true
+}
+
+// entrySelector are the arguments naming the entry to edit or delete.
+type entrySelector struct {
+	EntryID  string `json:"entryId"`
+	FoodItem string `json:"foodItem"`
+	Date     string `json:"date"`
+}
+
+// updateFoodArgs are the arguments of updateFood, nil when not changed.
+type updateFoodArgs struct {
+	entrySelector
+	NewFoodItem string   `json:"newFoodItem"`
+	Calories    *float64 `json:"calories"`
+	Meal        string   `json:"meal"`
+	Protein     *float64 `json:"protein"`
+	Carbs       *float64 `json:"carbs"`
+	Fat         *float64 `json:"fat"`
+	Fiber       *float64 `json:"fiber"`
+	Sugar       *float64 `json:"sugar"`
+	Sodium      *float64 `json:"sodium"`
+}
+
+// apply: Set the changed fields on f.
+func (a updateFoodArgs) apply(f Food) Food {
+	if a.NewFoodItem != "" {
+		f.Name = a.NewFoodItem
+	}
+	if a.Calories != nil {
+		f.Calories = int(*a.Calories)
+	}
+	if validMeal(a.Meal) {
+		f.Meal = a.Meal
+	}
+	if a.Protein != nil {
+		f.Protein = *a.Protein
+	}
+	if a.Carbs != nil {
+		f.Carbs = *a.Carbs
+	}
+	if a.Fat != nil {
+		f.Fat = *a.Fat
+	}
+	if a.Fiber != nil {
+		f.Fiber = *a.Fiber
+	}
+	if a.Sugar != nil {
+		f.Sugar = *a.Sugar
+	}
+	if a.Sodium != nil {
+		f.Sodium = *a.Sodium
+	}
+	return f
+}
+
+// updateFood: 修改一筆飲食紀錄
+func updateFood(ctx context.Context, uID string, args updateFoodArgs) map[string]any {
+	foods, err := visibleFoods(ctx, uID)
+	if err != nil {
+		return map[string]any{"status": "Failed", "reason": err.Error()}
+	}
+	key, before, ok := findFood(foods, args.EntryID, args.FoodItem, args.Date)
+	if !ok {
+		return map[string]any{"status": "Failed", "reason": "no matching food entry"}
+	}
+
+	f := args.apply(before)
+	if err := UpdateFood(ctx, uID, key, f); err != nil {
+		return map[string]any{"status": "Failed", "reason": err.Error()}
+	}
+	journal(ctx, uID, fmt.Sprintf("修改 %s", before.Name), journalChange{Op: OpUpdate, Key: key, Before: &before})
+	return map[string]any{
+		"entryId": key,
+		"entry":   f,
+		"status":  "Success",
+	}
+}
+
+// deleteFood: 找出要刪除的飲食紀錄，等使用者確認後才刪除
+func deleteFood(ctx context.Context, uID string, args entrySelector) (map[string]any, *messaging_api.QuickReply) {
+	foods, err := visibleFoods(ctx, uID)
+	if err != nil {
+		return map[string]any{"status": "Failed", "reason": err.Error()}, nil
+	}
+	key, f, ok := findFood(foods, args.EntryID, args.FoodItem, args.Date)
+	if !ok {
+		return map[string]any{"status": "Failed", "reason": "no matching food entry"}, nil
+	}
+	return map[string]any{
+		"entryId": key,
+		"entry":   f,
+		"status":  "WaitingForUserConfirmation",
+	}, deleteQuickReply(key, f)
+}
+
+// deleteQuickReply: Buttons confirming the deletion of an entry.
+func deleteQuickReply(key string, f Food) *messaging_api.QuickReply {
+	return &messaging_api.QuickReply{
+		Items: []messaging_api.QuickReplyItem{
+			{
+				Action: &messaging_api.PostbackAction{
+					Label:       "確認刪除",
+					Data:        "action=delete&key=" + key,
+					DisplayText: fmt.Sprintf("刪除 %s (%d 大卡)", f.Name, f.Calories),
+				},
+			}, {
+				Action: &messaging_api.PostbackAction{
+					Label:       "取消",
+					Data:        "action=cancel",
+					DisplayText: "取消",
+				},
+			},
+		},
+	}
+}
+
+// confirmDelete: Delete an entry once the user confirmed it.
+func confirmDelete(ctx context.Context, uID, key string) string {
+	foods, err := GetFoods(ctx, uID)
+	if err != nil {
+		return "無法刪除這筆紀錄，請稍後再試。"
+	}
+	f, ok := foods[key]
+	if !ok || key == "" {
+		return "這筆紀錄已經不存在了。"
+	}
+	if err := DeleteFood(ctx, uID, key); err != nil {
+		return "無法刪除這筆紀錄，請稍後再試。"
+	}
+	journal(ctx, uID, fmt.Sprintf("刪除 %s", f.Name), journalChange{Op: OpDelete, Key: key, Before: &f})
+	return fmt.Sprintf("已刪除 %s (%d 大卡)。\n\n%s", f.Name, f.Calories, budgetText(ctx, uID, foodDay(f)))
+}
+
+// entrySelectors are the arguments naming the entry to edit or delete.
+var entrySelectors = map[string]*genai.Schema{
+	"entryId": {
+		Type:        genai.TypeString,
+		Description: "The ID of the entry, when known",
+	},
+	"foodItem": {
+		Type:        genai.TypeString,
+		Description: "The name of the recorded food item to find",
+	},
+	"date": {
+		Type:        genai.TypeString,
+		Description: "The date of the entry in YYYY-MM-DD format, if the user tells it",
+	},
+}
+
+// updateFoodDeclaration declares the updateFood tool.
+var updateFoodDeclaration = &genai.FunctionDeclaration{
+	Name:        "updateFood",
+	Description: "Correct a recorded food entry, e.g. its calories, name, meal or macronutrients. The latest entry matching the food item is changed.",
+	Parameters: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: withNutrients(map[string]*genai.Schema{
+			"entryId":  entrySelectors["entryId"],
+			"foodItem": entrySelectors["foodItem"],
+			"date":     entrySelectors["date"],
+			"newFoodItem": {
+				Type:        genai.TypeString,
+				Description: "The corrected name of the food item",
+			},
+			"calories": {
+				Type:        genai.TypeNumber,
+				Description: "The corrected amount of calories",
+			},
+			"meal": mealSchema,
+		}),
+		Required: []string{"foodItem"},
+	},
+}
+
+// deleteFoodDeclaration declares the deleteFood tool.
+var deleteFoodDeclaration = &genai.FunctionDeclaration{
+	Name:        "deleteFood",
+	Description: "Delete a recorded food entry. The user is asked to confirm before it is removed.",
+	Parameters: &genai.Schema{
+		Type:       genai.TypeObject,
+		Properties: entrySelectors,
+		Required:   []string{"foodItem"},
+	},
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
-	"time"
 
 	firebase "firebase.google.com/go"
 	"firebase.google.com/go/db"
@@ -12,48 +12,56 @@ import (
 
 // Food is the struct for the food data
 type Food struct {
-	Name     string `json:"name"`
-	Calories int    `json:"calories"`
-	Date     string `json:"time"`
+	Name       string  `json:"name"`
+	Portion    string  `json:"portion,omitempty"`
+	Calories   int     `json:"calories"`
+	Confidence float64 `json:"confidence,omitempty"`
+	Timestamp  string  `json:"timestamp,omitempty"` // RFC 3339 time of eating
+	Date       string  `json:"date,omitempty"`      // YYYY-MM-DD in the user's time zone
+	LegacyTime string  `json:"time,omitempty"`      // free-form time of records saved before timestamps
+	Meal       string  `json:"meal,omitempty"`
+	MessageID  string  `json:"messageId,omitempty"`
+	GroupID    string  `json:"groupId,omitempty"` // group or room the entry was recorded in
+	Nutrients
 }
 
 // DBFoodPath is the path to the namecard data in the database
 const DBFoodPath = "food"
 
-// Define the context
-var fireDB FireDB
-
-// define firebase db
+// FireDB is the FoodStore backed by the Firebase Realtime Database.
 type FireDB struct {
-	path string
-	ctx  context.Context
 	*db.Client
 }
 
-// SetPath sets the path of the location in the database
-func (f *FireDB) SetPath(path string) {
-	f.path = path
-}
-
-// GetRef returns a reference to the location at the specified path.
-func (f *FireDB) GetFromDB(data interface{}) error {
-	if err := f.NewRef(f.path).Get(f.ctx, data); err != nil {
+// GetFromDB reads the data at path.
+func (f *FireDB) GetFromDB(ctx context.Context, path string, data interface{}) error {
+	if err := f.NewRef(path).Get(ctx, data); err != nil {
 		return err
 	}
 	return nil
 }
 
-// Insert data to firebase
-func (f *FireDB) InsertDB(data interface{}) error {
-	_, err := f.NewRef(f.path).Push(f.ctx, data)
+// InsertDB pushes data as a new child of path and returns its key.
+func (f *FireDB) InsertDB(ctx context.Context, path string, data interface{}) (string, error) {
+	ref, err := f.NewRef(path).Push(ctx, data)
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return ref.Key, nil
+}
+
+// SetDB writes data at path, replacing what was there.
+func (f *FireDB) SetDB(ctx context.Context, path string, data interface{}) error {
+	return f.NewRef(path).Set(ctx, data)
+}
+
+// DeleteDB removes path and all of its children.
+func (f *FireDB) DeleteDB(ctx context.Context, path string) error {
+	return f.NewRef(path).Delete(ctx)
 }
 
 // initFirebase: Initialize firebase
-func initFirebase(gap, firebaseURL string, ctx context.Context) {
+func initFirebase(gap, firebaseURL string, ctx context.Context) *FireDB {
 	log.Println("initFirebase")
 
 	opt := option.WithCredentialsJSON([]byte(gap))
@@ -66,37 +74,48 @@ func initFirebase(gap, firebaseURL string, ctx context.Context) {
 	if err != nil {
 		log.Fatalf("error initializing database: %v", err)
 	}
-	fireDB.Client = client
-	fireDB.ctx = ctx
-}
-
-// GetLocalTimeString: Get local time string
-func GetLocalTimeString() string {
-	timelocal, _ := time.LoadLocation("Asia/Taipei")
-	time.Local = timelocal
-	curNow := time.Now().Local().String()
-	return curNow
+	return &FireDB{Client: client}
 }
 
 // recordCalorie: 記錄卡路里攝入
-func recordCalorie(foodItem string, date string, calories int) map[string]any {
+func recordCalorie(ctx context.Context, uID string, foodItem string, date string, calories int, meal string, nutrients Nutrients) map[string]any {
 	// This hypothetical API returns a JSON such as:
-	// {"date":"2024-04-17","calories":200,"foodItem":"Apple","status":"Success"}
+	// {"date":"2024-04-17","calories":200,"foodItem":"Apple","status":"Success","dailyTotal":{...}}
+	eaten := intakeTime(date, userNow(ctx, uID))
+	// Without a meal type from the user, guess it from the time of eating.
+	if !validMeal(meal) {
+		meal = inferMeal(eaten)
+	}
 	calorie := Food{
-		Name:     foodItem,
-		Date:     date,
-		Calories: calories,
+		Name:      foodItem,
+		Calories:  calories,
+		Meal:      meal,
+		GroupID:   groupOf(ctx),
+		Nutrients: nutrients,
 	}
+	stampFood(&calorie, eaten)
 
 	// Insert the calorie intake to the database.
-	if err := fireDB.InsertDB(calorie); err != nil {
+	key, err := InsertFood(ctx, uID, calorie)
+	if err != nil {
 		log.Println("Storage save err:", err)
+	} else {
+		journal(ctx, uID, fmt.Sprintf("記錄 %s (%d 大卡)", foodItem, calories), journalChange{Op: OpInsert, Key: key, Day: foodDay(calorie)})
+	}
+
+	// Sum up the day of this intake.
+	foods, err := visibleFoods(ctx, uID)
+	if err != nil {
+		log.Println("Storage read err:", err)
 	}
 
 	return map[string]any{
-		"foodItem": foodItem,
-		"date":     date,
-		"calories": calories,
-		"status":   "Success",
+		"foodItem":   foodItem,
+		"date":       calorie.Date,
+		"calories":   calories,
+		"meal":       meal,
+		"nutrients":  nutrients,
+		"dailyTotal": dailyTotal(foods, foodDay(calorie)),
+		"status":     "Success",
 	}
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// Size limits of LINE messages.
+const (
+	FlexMaxSize        = 30 * 1024 // bytes of a Flex Message object
+	AltTextMaxLen      = 400       // characters of the alt text (LINE allows 1500)
+	TextMaxLen         = 5000      // characters of a text message
+	QuickReplyMaxItems = 13        // buttons of a quick reply
+)
+
+// progressHeight is the height of the daily progress bar.
+const progressHeight = "8px"
+
+// Colors of the food cards.
+const (
+	colorPrimary = "#1DB446"
+	colorOver    = "#E53935"
+	colorMuted   = "#AAAAAA"
+	colorTrack   = "#EEEEEE"
+)
+
+// foodCard is a food analysis result rendered as a Flex Message.
+type foodCard struct {
+	Title string
+	Foods []Food     // detected dishes, may be empty
+	Total DailyTotal // consumption of the day, shown when Foods is set
+	Goal  int        // daily calorie target, 0 when unset
+	Note  string     // free text such as the model's description
+}
+
+// cardMessage: Build the message of a card, falling back to plain text when
+// the Flex payload exceeds the LINE size limit.
+func cardMessage(c foodCard, qReply *messaging_api.QuickReply) messaging_api.MessageInterface {
+	msg := &messaging_api.FlexMessage{
+		AltText:    truncate(c.Title+" "+c.Note, AltTextMaxLen),
+		Contents:   flexFoodCard(c),
+		QuickReply: qReply,
+	}
+	raw, err := json.Marshal(msg)
+	if err == nil && len(raw) <= FlexMaxSize {
+		return msg
+	}
+	return &messaging_api.TextMessage{
+		Text:       truncate(foodCardText(c), TextMaxLen),
+		QuickReply: qReply,
+	}
+}
+
+// flexFoodCard: Render a card as a Flex bubble.
+func flexFoodCard(c foodCard) *messaging_api.FlexBubble {
+	body := []messaging_api.FlexComponentInterface{
+		&messaging_api.FlexText{Text: c.Title, Weight: messaging_api.FlexTextWEIGHT_BOLD, Size: "xl", Color: colorPrimary, Wrap: true},
+	}
+
+	if len(c.Foods) > 0 {
+		body = append(body, &messaging_api.FlexSeparator{Margin: "md"})
+		var calories int
+		var macros Nutrients
+		for _, f := range c.Foods {
+			name := f.Name
+			if f.Portion != "" {
+				name = fmt.Sprintf("%s (%s)", f.Name, f.Portion)
+			}
+			body = append(body, flexRow(name, fmt.Sprintf("%d 大卡", f.Calories), "sm"))
+			calories += f.Calories
+			macros = macros.Add(f.Nutrients)
+		}
+		body = append(body,
+			&messaging_api.FlexSeparator{Margin: "md"},
+			flexRow("合計", fmt.Sprintf("%d 大卡", calories), "md"),
+			&messaging_api.FlexText{Text: macroText(macros), Size: "xs", Color: colorMuted, Wrap: true, Margin: "sm"},
+		)
+		body = append(body, flexProgress(c.Total, c.Goal)...)
+	}
+
+	if c.Note != "" {
+		body = append(body,
+			&messaging_api.FlexSeparator{Margin: "md"},
+			&messaging_api.FlexText{Text: c.Note, Size: "sm", Wrap: true, Margin: "md"},
+		)
+	}
+
+	return &messaging_api.FlexBubble{
+		Size: messaging_api.FlexBubbleSIZE_GIGA,
+		Body: &messaging_api.FlexBox{
+			Layout:   messaging_api.FlexBoxLAYOUT_VERTICAL,
+			Spacing:  "sm",
+			Contents: body,
+		},
+	}
+}
+
+// flexRow: A name and value row of a card.
+func flexRow(name, value, size string) *messaging_api.FlexBox {
+	return &messaging_api.FlexBox{
+		Layout: messaging_api.FlexBoxLAYOUT_HORIZONTAL,
+		Contents: []messaging_api.FlexComponentInterface{
+			&messaging_api.FlexText{Text: name, Size: size, Flex: 3, Wrap: true},
+			&messaging_api.FlexText{Text: value, Size: size, Flex: 2, Align: messaging_api.FlexTextALIGN_END},
+		},
+	}
+}
+
+// flexProgress: The daily calorie progress of a card.
+func flexProgress(total DailyTotal, goal int) []messaging_api.FlexComponentInterface {
+	if goal <= 0 {
+		return []messaging_api.FlexComponentInterface{
+			&messaging_api.FlexText{Text: fmt.Sprintf("%s 已攝取 %d 大卡（尚未設定每日目標）", total.Date, total.Calories), Size: "xs", Color: colorMuted, Wrap: true, Margin: "md"},
+		}
+	}
+
+	percent := total.Calories * 100 / goal
+	color := colorPrimary
+	if percent > 100 {
+		color = colorOver
+	}
+	width := percent
+	if width > 100 {
+		width = 100
+	}
+	components := []messaging_api.FlexComponentInterface{
+		&messaging_api.FlexText{Text: fmt.Sprintf("%s 已攝取 %d / %d 大卡 (%d%%)", total.Date, total.Calories, goal, percent), Size: "xs", Color: colorMuted, Wrap: true, Margin: "md"},
+	}
+	bar := []messaging_api.FlexComponentInterface{
+		&messaging_api.FlexFiller{},
+	}
+	if width > 0 {
+		bar = []messaging_api.FlexComponentInterface{
+			&messaging_api.FlexBox{
+				Layout:          messaging_api.FlexBoxLAYOUT_VERTICAL,
+				Width:           fmt.Sprintf("%d%%", width),
+				Height:          progressHeight,
+				BackgroundColor: color,
+				Contents:        []messaging_api.FlexComponentInterface{&messaging_api.FlexFiller{}},
+			},
+		}
+	}
+	return append(components, &messaging_api.FlexBox{
+		Layout:          messaging_api.FlexBoxLAYOUT_VERTICAL,
+		Height:          progressHeight,
+		BackgroundColor: colorTrack,
+		Margin:          "sm",
+		Contents:        bar,
+	})
+}
+
+// macroText: Describe the macronutrients in one line.
+func macroText(n Nutrients) string {
+	return fmt.Sprintf("蛋白質 %.0fg・碳水 %.0fg・脂肪 %.0fg・纖維 %.0fg・糖 %.0fg・鈉 %.0fmg",
+		n.Protein, n.Carbs, n.Fat, n.Fiber, n.Sugar, n.Sodium)
+}
+
+// foodCardText: Render a card as plain text.
+func foodCardText(c foodCard) string {
+	var sb strings.Builder
+	sb.WriteString(c.Title)
+	if len(c.Foods) > 0 {
+		var calories int
+		var macros Nutrients
+		for _, f := range c.Foods {
+			fmt.Fprintf(&sb, "\n• %s", f.Name)
+			if f.Portion != "" {
+				fmt.Fprintf(&sb, " (%s)", f.Portion)
+			}
+			fmt.Fprintf(&sb, " %d 大卡", f.Calories)
+			calories += f.Calories
+			macros = macros.Add(f.Nutrients)
+		}
+		fmt.Fprintf(&sb, "\n合計 %d 大卡\n%s", calories, macroText(macros))
+		if c.Goal > 0 {
+			fmt.Fprintf(&sb, "\n%s 已攝取 %d / %d 大卡", c.Total.Date, c.Total.Calories, c.Goal)
+		} else {
+			fmt.Fprintf(&sb, "\n%s 已攝取 %d 大卡", c.Total.Date, c.Total.Calories)
+		}
+	}
+	if c.Note != "" {
+		sb.WriteString("\n\n" + c.Note)
+	}
+	return sb.String()
+}
+
+// truncate: Cut s to at most n characters.
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
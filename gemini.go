@@ -5,22 +5,23 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"strconv"
-	"strings"
-	"time"
+	"slices"
 
 	"github.com/google/generative-ai-go/genai"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
 	"google.golang.org/api/option"
 )
 
+// MaxToolSteps is the most rounds of function calls for one message.
+const MaxToolSteps = 5
+
+// GeminiApp is the LLM backed by the Google Gemini API.
 type GeminiApp struct {
 	geminiKey string
-	ctx       context.Context
 	client    *genai.Client
+	breaker   *CircuitBreaker
 }
 
-var calorieTrackingTool *genai.Tool
-
 func InitGemini(key string) *GeminiApp {
 	ctx := context.Background()
 	client, err := genai.NewClient(ctx, option.WithAPIKey(key))
@@ -28,52 +29,10 @@ func InitGemini(key string) *GeminiApp {
 		log.Fatal(err)
 	}
 
-	calorieTrackingTool = &genai.Tool{
-		FunctionDeclarations: []*genai.FunctionDeclaration{{
-			Name:        "recordCalorie",
-			Description: "Record a calorie intake with date, amount, and food item",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
-					"foodItem": {
-						Type:        genai.TypeString,
-						Description: "The name of the food item",
-					},
-					"date": {
-						Type:        genai.TypeString,
-						Description: "The date of the intake in YYYY-MM-DD format",
-					},
-					"calories": {
-						Type:        genai.TypeNumber,
-						Description: "The amount of calories",
-					},
-				},
-				Required: []string{"foodItem", "date", "calories"},
-			},
-		}, {
-			Name:        "recordFood",
-			Description: "Record a eating with date and food item",
-			Parameters: &genai.Schema{
-				Type: genai.TypeObject,
-				Properties: map[string]*genai.Schema{
-					"foodItem": {
-						Type:        genai.TypeString,
-						Description: "The name of the food item",
-					},
-					"date": {
-						Type:        genai.TypeString,
-						Description: "The date of the intake in YYYY-MM-DD format",
-					},
-				},
-				Required: []string{"foodItem", "date"},
-			},
-		}},
-	}
-
-	return &GeminiApp{key, ctx, client}
+	return &GeminiApp{key, client, NewCircuitBreaker(BreakerThreshold, BreakerCooldown)}
 }
 
-func (app *GeminiApp) GeminiImage(imgData []byte, prompt string) (string, error) {
+func (app *GeminiApp) GeminiImage(ctx context.Context, imgData []byte, prompt string) (string, error) {
 	model := app.client.GenerativeModel("gemini-1.5-flash")
 	// Set the temperature to 0.8 for a balance between creativity and coherence.
 	value := float32(0.8)
@@ -83,7 +42,9 @@ func (app *GeminiApp) GeminiImage(imgData []byte, prompt string) (string, error)
 		genai.Text(prompt),
 	}
 	fmt.Println("Begin processing image...")
-	resp, err := model.GenerateContent(app.ctx, data...)
+	resp, err := app.generate(ctx, func(ctx context.Context) (*genai.GenerateContentResponse, error) {
+		return model.GenerateContent(ctx, data...)
+	})
 	fmt.Println("Finished processing image...", resp)
 	if err != nil {
 		fmt.Println("err:", err)
@@ -93,141 +54,258 @@ func (app *GeminiApp) GeminiImage(imgData []byte, prompt string) (string, error)
 	return printResponse(resp), nil
 }
 
+// GeminiImageJSON: Input an image and a prompt, get a JSON answer following
+// the schema.
+func (app *GeminiApp) GeminiImageJSON(ctx context.Context, imgData []byte, prompt string, schema *genai.Schema) (string, error) {
+	model := app.client.GenerativeModel("gemini-1.5-flash")
+	// Keep the estimation stable between calls.
+	value := float32(0.2)
+	model.Temperature = &value
+	model.ResponseMIMEType = "application/json"
+	model.ResponseSchema = schema
+	data := []genai.Part{
+		genai.ImageData("png", imgData),
+		genai.Text(prompt),
+	}
+	fmt.Println("Begin processing image json...")
+	resp, err := app.generate(ctx, func(ctx context.Context) (*genai.GenerateContentResponse, error) {
+		return model.GenerateContent(ctx, data...)
+	})
+	if err != nil {
+		fmt.Println("err:", err)
+		return "", err
+	}
+
+	return printResponse(resp), nil
+}
+
 // Gemini Chat Complete: Iput a prompt and get the response string.
-func (app *GeminiApp) GeminiChatComplete(req string) string {
+func (app *GeminiApp) GeminiChatComplete(ctx context.Context, req string) (string, error) {
 	model := app.client.GenerativeModel("gemini-1.5-flash")
 	value := float32(0.8)
 	model.Temperature = &value
+	cs := &geminiChat{app, model.StartChat()}
+
+	fmt.Printf("== Me: %s\n== Model:\n", req)
+	res, err := cs.SendMessage(ctx, genai.Text(req))
+	if err != nil {
+		fmt.Println("err:", err)
+		return "", err
+	}
+	return printResponse(res), nil
+}
+
+// StartChat starts a chat session with the given tools and history, using a
+// model that supports function calling.
+func (app *GeminiApp) StartChat(history []*genai.Content, tools []*genai.Tool) ChatSession {
+	model := app.client.GenerativeModel("gemini-1.5-flash-latest")
+	model.Tools = tools
 	cs := model.StartChat()
+	cs.History = history
+	return &geminiChat{app, cs}
+}
 
-	send := func(msg string) *genai.GenerateContentResponse {
-		fmt.Printf("== Me: %s\n== Model:\n", msg)
-		res, err := cs.SendMessage(app.ctx, genai.Text(msg))
-		if err != nil {
+// Close releases the Gemini client.
+func (app *GeminiApp) Close() error {
+	return app.client.Close()
+}
+
+// Gemini Function Call: Input a prompt and get the response string, with the
+// quick reply buttons a tool asked for. In the one-to-one chat the
+// conversation continues from the chat history of the user, which the
+// exchange is added to. Group chats neither see nor add to that history.
+// Records are read and written for the user uID only.
+func GeminiFunctionCall(ctx context.Context, uID, prompt string) (string, *messaging_api.QuickReply) {
+	personal := groupOf(ctx) == ""
+	var history ChatHistory
+	if personal {
+		var err error
+		if history, err = GetChatHistory(ctx, uID); err != nil {
 			fmt.Println("err:", err)
 		}
-		return res
 	}
-
-	res := send(req)
-	return printResponse(res)
+	answer, qReply, err := functionCall(ctx, uID, prompt, history.Contents())
+	// Keep apologies out of the memory.
+	if err == nil && personal {
+		remember(ctx, uID, prompt, answer)
+	}
+	return answer, qReply
 }
 
-// Gemini Function Call: Input a prompt and get the response string.
-func (app *GeminiApp) GeminiFunctionCall(prompt string) string {
+// functionCall: Answer the prompt in a chat session seeded with the history.
+func functionCall(ctx context.Context, uID, prompt string, history []*genai.Content) (string, *messaging_api.QuickReply, error) {
 	// Add timestamp for this prompt.
-	timelocal, _ := time.LoadLocation("Asia/Taipei")
-	time.Local = timelocal
-	curNow := time.Now().Local().String()
+	curNow := userNow(ctx, uID).Format("2006-01-02 15:04 Monday MST")
 	prompt = prompt + " 本地時間: " + curNow
-	// Use a model that supports function calling, like Gemini 1.0 Pro.
-	model := app.client.GenerativeModel("gemini-1.5-flash-latest")
-
-	// Specify the function declaration.
-	model.Tools = []*genai.Tool{calorieTrackingTool}
-	// Start new chat session.
-	session := model.StartChat()
+	// Start the chat session with the function declarations of this chat.
+	tools := toolsFor(ctx)
+	session := gemini.StartChat(history, []*genai.Tool{tools.GenaiTool()})
 	// Send the message to the generative model.
-	resp, err := session.SendMessage(app.ctx, genai.Text(prompt))
+	resp, err := session.SendMessage(ctx, genai.Text(prompt))
 	if err != nil {
-		fmt.Println("err:", err)
+		return friendlyError(err), nil, err
 	}
 
-	// Check that you got the expected function call back.
-	part := resp.Candidates[0].Content.Parts[0]
-	_, ok := part.(genai.FunctionCall)
-	if ok {
-		fmt.Printf("Received function call response:\n %s \n %s \n", part.(genai.FunctionCall).Name, part.(genai.FunctionCall).Args)
-
-		// According to function call Name and Args we can call the function
-		switch part.(genai.FunctionCall).Name {
-		case "recordCalorie":
-			fmt.Println("Calling recordCalorie function...")
-			args := part.(genai.FunctionCall).Args
-			foodItem := args["foodItem"]
-			date := args["date"]
-			calories := args["calories"]
-
-			//convert float64 to int
-			caloriesInt, err := strconv.Atoi(fmt.Sprintf("%v", calories))
-			if err != nil {
-				fmt.Println("err:", err)
-				return fmt.Sprintf("err: %v", err)
-			}
-
-			fmt.Println("date: ", date, "calories: ", calories, "foodItem: ", foodItem)
-			// Call the hypothetical API to record the calorie intake.
-			apiResult := recordCalorie(foodItem.(string), date.(string), caloriesInt)
-			// Send the hypothetical API result back to the generative model.
-			fmt.Printf("Sending API result:\n%q\n\n", apiResult)
-			resp, err = session.SendMessage(app.ctx, genai.FunctionResponse{
-				Name:     calorieTrackingTool.FunctionDeclarations[0].Name,
-				Response: apiResult,
-			})
-			if err != nil {
-				fmt.Println("msg err:", err)
-				return fmt.Sprintf("msg err: %v", err)
-			}
-			// Show the model's response, which is expected to be text.
-			return printResponse(resp)
-		case "recordFood":
-			fmt.Println("Calling recordFood function...")
-			args := part.(genai.FunctionCall).Args
-			foodItem := args["foodItem"]
-			date := args["date"]
-
-			fmt.Println("Asking Gemini to guess the calories...")
-			// using default prompt to ask user.
-			prompt := fmt.Sprintf("我剛剛吃了 %s, 請幫我猜測卡路里，大概就好，只要回覆我數字。", foodItem)
-			caloriesString := app.GeminiChatComplete(prompt)
-			// Convert string to integer, e.g. "800 \n"
-			caloriesString = removeFirstAndLastLine(caloriesString)
-			calories, err := strconv.Atoi(caloriesString)
-			fmt.Println("gemini guess calories: ", calories)
-			if err != nil {
-				fmt.Println("err:", err)
-				return fmt.Sprintf("err: %v", err)
-			}
-			fmt.Println("date: ", date, "calories: ", calories, "foodItem: ", foodItem)
-			// Call the hypothetical API to record the calorie intake.
-			apiResult := recordCalorie(foodItem.(string), date.(string), calories)
-			// Send the hypothetical API result back to the generative model.
-			fmt.Printf("Sending API result:\n%q\n\n", apiResult)
-			resp, err = session.SendMessage(app.ctx, genai.FunctionResponse{
-				Name:     calorieTrackingTool.FunctionDeclarations[0].Name,
-				Response: apiResult,
-			})
-			if err != nil {
-				fmt.Println("msg err:", err)
-				return fmt.Sprintf("msg err: %v", err)
-			}
-			// Show the model's response, which is expected to be text.
-			return printResponse(resp)
-		}
+	// Check that you got the expected function calls back.
+	calls := functionCalls(resp)
+	if len(calls) > 0 {
+		return runTools(ctx, uID, session, tools, calls)
 	}
 	// Other cases, return the response as text.
-	fmt.Printf("Expected type FunctionCall, got %T\n", part)
+	fmt.Println("Expected FunctionCall, got none")
 
-	// If no function call was made, return the response as text.
-	var foods map[string]Food
-	if err := fireDB.GetFromDB(&foods); err != nil {
+	// If no function call was made, answer from the computed summaries
+	// instead of the raw records.
+	foods, err := visibleFoods(ctx, uID)
+	if err != nil {
 		fmt.Println(err)
 	}
+	profile, err := GetProfile(ctx, uID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	var summaries []any
+	for _, period := range []string{PeriodDay, PeriodWeek, PeriodMonth} {
+		summaries = append(summaries, getSummary(foods, profile, period, "")["summary"])
+	}
 	// Marshall to json
-	jsonData, err := json.Marshal(foods)
+	jsonData, err := json.Marshal(summaries)
 	if err != nil {
 		fmt.Println(err)
 	}
 
-	// using default prompt to ask user.
-	prompt = fmt.Sprintf("目前您的卡路里資料如下: %s  \n\n 幫我回答我的問題: %s\n", jsonData, prompt)
-	return app.GeminiChatComplete(prompt)
+	// using default prompt to ask user, in the same session to keep the
+	// conversation.
+	prompt = fmt.Sprintf("目前您今天、本週與本月的飲食統計如下 (數字已經計算好，請直接引用，不要自己重新計算): %s  \n\n 幫我回答我的問題: %s\n", jsonData, prompt)
+	resp, err = session.SendMessage(ctx, genai.Text(prompt))
+	if err != nil {
+		return friendlyError(err), nil, err
+	}
+	if calls := functionCalls(resp); len(calls) > 0 {
+		return runTools(ctx, uID, session, tools, calls)
+	}
+	return printResponse(resp), nil, nil
+}
+
+// runTools: Run the function calls of the model and send back their results
+// until the model answers with text, at most MaxToolSteps rounds.
+// The tools that already ran are still reported when the model fails.
+func runTools(ctx context.Context, uID string, session ChatSession, tools *ToolRegistry, calls []genai.FunctionCall) (string, *messaging_api.QuickReply, error) {
+	// Everything the tools write for this message is undone at once.
+	ctx, batch := withJournalBatch(ctx)
+	defer batch.flush(ctx, uID)
+
+	var results []toolResult
+	for step := 0; ; step++ {
+		if step == MaxToolSteps {
+			fmt.Println("Too many function call steps, stop at:", calls)
+			answer, qReply := toolsAnswer(ctx, uID, "這個要求的步驟太多了，我先處理到這裡，請再告訴我還需要做什麼。", results)
+			return answer, qReply, nil
+		}
+
+		// Run every call of this round, the model gets all results at once.
+		parts := make([]genai.Part, 0, len(calls))
+		for _, call := range calls {
+			funcResp, result := tools.Dispatch(ctx, uID, call)
+			parts = append(parts, funcResp)
+			results = append(results, result)
+		}
+		resp, err := session.SendMessage(ctx, parts...)
+		if err != nil {
+			answer, qReply := toolsAnswer(ctx, uID, friendlyError(err), results)
+			return answer, qReply, err
+		}
+		calls = functionCalls(resp)
+		if len(calls) == 0 {
+			// Show the model's response, which is expected to be text.
+			answer, qReply := toolsAnswer(ctx, uID, printResponse(resp), results)
+			return answer, qReply, nil
+		}
+	}
+}
+
+// toolsAnswer: The model's answer followed by the budget of the days the
+// tools changed, with the quick replies the tools asked for.
+func toolsAnswer(ctx context.Context, uID, answer string, results []toolResult) (string, *messaging_api.QuickReply) {
+	var days []string
+	var qReply *messaging_api.QuickReply
+	for _, r := range results {
+		if r.BudgetDay != "" && !slices.Contains(days, r.BudgetDay) {
+			days = append(days, r.BudgetDay)
+		}
+		qReply = mergeQuickReplies(qReply, r.QuickReply)
+	}
+	for _, day := range days {
+		answer = answer + "\n\n" + budgetText(ctx, uID, day)
+	}
+	return answer, qReply
+}
+
+// mergeQuickReplies: Join the buttons of two quick replies, skipping
+// repeated labels and keeping to the LINE limit.
+func mergeQuickReplies(a, b *messaging_api.QuickReply) *messaging_api.QuickReply {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	merged := &messaging_api.QuickReply{Items: append([]messaging_api.QuickReplyItem(nil), a.Items...)}
+	for _, item := range b.Items {
+		if len(merged.Items) == QuickReplyMaxItems {
+			break
+		}
+		if !slices.ContainsFunc(merged.Items, func(i messaging_api.QuickReplyItem) bool {
+			return quickReplyLabel(i) == quickReplyLabel(item)
+		}) {
+			merged.Items = append(merged.Items, item)
+		}
+	}
+	return merged
+}
+
+// quickReplyLabel: The label of a quick reply button.
+func quickReplyLabel(item messaging_api.QuickReplyItem) string {
+	switch a := item.Action.(type) {
+	case *messaging_api.PostbackAction:
+		return a.Label
+	case *messaging_api.MessageAction:
+		return a.Label
+	case *messaging_api.CameraAction:
+		return a.Label
+	}
+	return fmt.Sprintf("%v", item.Action)
+}
+
+// functionCalls: The function calls of a response, in order.
+func functionCalls(resp *genai.GenerateContentResponse) []genai.FunctionCall {
+	var calls []genai.FunctionCall
+	if resp == nil {
+		return nil
+	}
+	for _, cand := range resp.Candidates {
+		if cand.Content == nil {
+			continue
+		}
+		for _, part := range cand.Content.Parts {
+			if call, ok := part.(genai.FunctionCall); ok {
+				calls = append(calls, call)
+			}
+		}
+	}
+	return calls
 }
 
 // Print the response
 func printResponse(resp *genai.GenerateContentResponse) string {
 	var ret string
+	if resp == nil {
+		return ret
+	}
 	for _, cand := range resp.Candidates {
+		if cand.Content == nil {
+			continue
+		}
 		for _, part := range cand.Content.Parts {
 			ret = ret + fmt.Sprintf("%v", part)
 			fmt.Println(part)
@@ -235,17 +313,3 @@ func printResponse(resp *genai.GenerateContentResponse) string {
 	}
 	return ret
 }
-
-// removeFirstAndLastLine takes a string and removes the first and last lines.
-func removeFirstAndLastLine(s string) string {
-	// Split the string into lines.
-	lines := strings.Split(s, "\n")
-
-	// If there are less than 3 lines, return an empty string because removing the first and last would leave nothing.
-	if len(lines) < 3 {
-		return ""
-	}
-
-	// Join the lines back together, skipping the first and last lines.
-	return strings.Join(lines[1:len(lines)-1], "\n")
-}
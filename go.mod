@@ -8,6 +8,7 @@ require (
 	github.com/google/generative-ai-go v0.16.0
 	github.com/line/line-bot-sdk-go/v7 v7.21.0
 	github.com/line/line-bot-sdk-go/v8 v8.6.0
+	go.etcd.io/bbolt v1.3.10
 	google.golang.org/api v0.186.0
 )
 
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+// DBGroupPath is the path to the group diaries in the database. A group
+// diary only lists its members: the entries stay in the food records of
+// each member, tagged with the group ID, and the group views are computed
+// from them.
+const DBGroupPath = "group"
+
+// botUserID is the user ID of the bot, to find its mentions in groups.
+var botUserID string
+
+// chatSource is who sent an event and in which chat.
+type chatSource struct {
+	UserID  string // member who sent the event, empty when LINE omits it
+	GroupID string // group or room ID, empty in a one-to-one chat
+	Room    bool   // GroupID is a room rather than a group
+}
+
+// sourceOf: Get the sender and the chat of an event source.
+func sourceOf(source webhook.SourceInterface) chatSource {
+	switch s := source.(type) {
+	case webhook.UserSource:
+		return chatSource{UserID: s.UserId}
+	case webhook.GroupSource:
+		return chatSource{UserID: s.UserId, GroupID: s.GroupId}
+	case webhook.RoomSource:
+		return chatSource{UserID: s.UserId, GroupID: s.RoomId, Room: true}
+	}
+	return chatSource{}
+}
+
+// groupKey is the context key of the group an event comes from.
+type groupKey struct{}
+
+// withGroup: Mark the context as handling an event of the group gID.
+func withGroup(ctx context.Context, gID string) context.Context {
+	if gID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, groupKey{}, gID)
+}
+
+// groupOf: Get the group the event being handled comes from, empty in a
+// one-to-one chat.
+func groupOf(ctx context.Context) string {
+	gID, _ := ctx.Value(groupKey{}).(string)
+	return gID
+}
+
+// GroupMember is a member of a group diary.
+type GroupMember struct {
+	Name   string `json:"name"`
+	Joined string `json:"joined"`
+}
+
+// groupMembersPath returns the path of the members of a group diary.
+func groupMembersPath(gID string) string {
+	return fmt.Sprintf("%s/%s/members", DBGroupPath, gID)
+}
+
+// GetGroupMembers returns the members of the group diary by user ID.
+func GetGroupMembers(ctx context.Context, gID string) (map[string]GroupMember, error) {
+	members := map[string]GroupMember{}
+	err := foodDB.GetFromDB(ctx, groupMembersPath(gID), &members)
+	return members, err
+}
+
+// joinGroup: Add the sender to the diary of the group, once.
+func joinGroup(ctx context.Context, src chatSource) {
+	if src.GroupID == "" || src.UserID == "" {
+		return
+	}
+	path := fmt.Sprintf("%s/%s", groupMembersPath(src.GroupID), src.UserID)
+	var m GroupMember
+	if err := foodDB.GetFromDB(ctx, path, &m); err == nil && m.Joined != "" {
+		return
+	}
+	m = GroupMember{
+		Name:   memberName(src),
+		Joined: time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := foodDB.SetDB(ctx, path, m); err != nil {
+		log.Println("Join group err:", err)
+	}
+}
+
+// memberName: Get the display name of the sender in the group.
+func memberName(src chatSource) string {
+	if src.Room {
+		p, err := bot.GetRoomMemberProfile(src.GroupID, src.UserID)
+		if err != nil {
+			log.Println("Room member profile err:", err)
+			return src.UserID
+		}
+		return p.DisplayName
+	}
+	p, err := bot.GetGroupMemberProfile(src.GroupID, src.UserID)
+	if err != nil {
+		log.Println("Group member profile err:", err)
+		return src.UserID
+	}
+	return p.DisplayName
+}
+
+// botMentions: The mentions of the bot in a text message.
+func botMentions(message webhook.TextMessageContent) []webhook.UserMentionee {
+	var mentions []webhook.UserMentionee
+	if message.Mention == nil || botUserID == "" {
+		return nil
+	}
+	for _, m := range message.Mention.Mentionees {
+		if u, ok := m.(webhook.UserMentionee); ok && u.UserId == botUserID {
+			mentions = append(mentions, u)
+		}
+	}
+	return mentions
+}
+
+// stripMentions: Remove the mentions of the bot from the text. LINE counts
+// the index and length of a mention in UTF-16 code units.
+func stripMentions(message webhook.TextMessageContent) string {
+	mentions := botMentions(message)
+	if len(mentions) == 0 {
+		return message.Text
+	}
+	// Cut from the end so the earlier indexes stay valid.
+	sort.Slice(mentions, func(i, j int) bool { return mentions[i].Index > mentions[j].Index })
+	text := utf16.Encode([]rune(message.Text))
+	for _, m := range mentions {
+		from, to := int(m.Index), int(m.Index+m.Length)
+		if from < 0 || to > len(text) || from > to {
+			continue
+		}
+		text = append(text[:from], text[to:]...)
+	}
+	return strings.TrimSpace(string(utf16.Decode(text)))
+}
+
+// groupFoods: The entries recorded in the group gID.
+func groupFoods(foods map[string]Food, gID string) map[string]Food {
+	ret := map[string]Food{}
+	for k, f := range foods {
+		if f.GroupID == gID {
+			ret[k] = f
+		}
+	}
+	return ret
+}
+
+// visibleFoods: Get the food records of the user that may be shown in the
+// chat the event comes from: all of them in the one-to-one chat, only the
+// ones recorded in the group otherwise, so the other members never see the
+// personal diary.
+func visibleFoods(ctx context.Context, uID string) (map[string]Food, error) {
+	foods, err := GetFoods(ctx, uID)
+	if gID := groupOf(ctx); gID != "" && err == nil {
+		foods = groupFoods(foods, gID)
+	}
+	return foods, err
+}
+
+// MemberSummary is the summary of the entries a member recorded in a group.
+type MemberSummary struct {
+	Name    string  `json:"name"`
+	Summary Summary `json:"summary"`
+}
+
+// getGroupSummary: 計算群組每位成員在指定期間的飲食統計
+func getGroupSummary(ctx context.Context, gID, period, date string) map[string]any {
+	if gID == "" {
+		return map[string]any{"status": "Failed", "reason": "not in a group chat"}
+	}
+	members, err := GetGroupMembers(ctx, gID)
+	if err != nil {
+		return map[string]any{"status": "Failed", "reason": err.Error()}
+	}
+
+	var summaries []MemberSummary
+	var nutrients Nutrients
+	entries, calories := 0, 0
+	for uID, m := range members {
+		foods, err := GetFoods(ctx, uID)
+		if err != nil {
+			log.Println("Group member foods err:", err)
+			continue
+		}
+		profile, err := GetProfile(ctx, uID)
+		if err != nil {
+			log.Println("Profile read err:", err)
+		}
+		ret := getSummary(groupFoods(foods, gID), profile, period, date)
+		s, ok := ret["summary"].(Summary)
+		if !ok {
+			return ret
+		}
+		summaries = append(summaries, MemberSummary{Name: m.Name, Summary: s})
+		entries += s.Entries
+		calories += s.Calories
+		nutrients = nutrients.Add(s.Nutrients)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Summary.Calories > summaries[j].Summary.Calories })
+
+	return map[string]any{
+		"members":   summaries,
+		"entries":   entries,
+		"calories":  calories,
+		"nutrients": nutrients,
+		"status":    "Success",
+	}
+}
+
+// groupSummaryArgs are the arguments of getGroupSummary.
+type groupSummaryArgs struct {
+	Period string `json:"period"`
+	Date   string `json:"date"`
+}
+
+// groupTools are the tools offered to Gemini in group chats.
+var groupTools = calorieTools.With(
+	newTool(groupSummaryDeclaration, func(ctx context.Context, uID string, args groupSummaryArgs) toolResult {
+		return toolResult{Response: getGroupSummary(ctx, groupOf(ctx), args.Period, args.Date)}
+	}),
+)
+
+// toolsFor: The tools offered for the chat the event comes from.
+func toolsFor(ctx context.Context) *ToolRegistry {
+	if groupOf(ctx) != "" {
+		return groupTools
+	}
+	return calorieTools
+}
+
+// groupSummaryDeclaration declares the getGroupSummary tool.
+var groupSummaryDeclaration = &genai.FunctionDeclaration{
+	Name:        "getGroupSummary",
+	Description: "Get the already computed totals of every member of this group chat for a day, ISO week or month, counting the entries recorded in the group. Use it for questions about the group, e.g. the group total or who ate the most of something.",
+	Parameters: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"period": {
+				Type:        genai.TypeString,
+				Description: "The period to summarize",
+				Format:      "enum",
+				Enum:        []string{PeriodDay, PeriodWeek, PeriodMonth},
+			},
+			"date": {
+				Type:        genai.TypeString,
+				Description: "A date inside the period in YYYY-MM-DD format, today if omitted",
+			},
+		},
+	},
+}
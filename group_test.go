@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+// testBotID is the user ID of the bot in the tests.
+const testBotID = "Ubot"
+
+// useBotUserID sets the user ID of the bot for the test.
+func useBotUserID(t *testing.T) {
+	t.Helper()
+	prev := botUserID
+	botUserID = testBotID
+	t.Cleanup(func() { botUserID = prev })
+}
+
+// groupTextEvent is a text message mentioning the bot in a group, from uID
+// which may be empty when the member did not consent to share it.
+func groupTextEvent(gID, uID, text string) webhook.MessageEvent {
+	return webhook.MessageEvent{
+		ReplyToken: "reply-" + gID,
+		Source:     webhook.GroupSource{GroupId: gID, UserId: uID},
+		Message: webhook.TextMessageContent{
+			Id:   "g1",
+			Text: "@bot " + text,
+			Mention: &webhook.Mention{Mentionees: []webhook.MentioneeInterface{
+				webhook.UserMentionee{Index: 0, Length: 4, UserId: testBotID},
+			}},
+		},
+	}
+}
+
+// seedFood stores an entry of today for the user, recorded in gID or in the
+// personal chat when gID is empty.
+func seedFood(t *testing.T, uID, gID, name string, calories int) {
+	t.Helper()
+	f := Food{Name: name, Calories: calories, GroupID: gID}
+	stampFood(&f, userNow(context.Background(), uID))
+	if _, err := InsertFood(context.Background(), uID, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupChatKeepsPersonalDataPrivate(t *testing.T) {
+	useTestStore(t)
+	useFakeLINE(t)
+	useBotUserID(t)
+	llm := useFakeLLM(t)
+	ctx := context.Background()
+	uID, gID := "Ualice", "Gfamily"
+
+	personal := ChatHistory{Summary: "私下在減重，喜歡炸雞", Turns: []ChatTurn{{User: "我吃了炸雞", Model: "已記錄"}}}
+	if err := SaveChatHistory(ctx, uID, personal); err != nil {
+		t.Fatal(err)
+	}
+	seedFood(t, uID, "", "炸雞", 999)
+	seedFood(t, uID, gID, "火鍋", 321)
+
+	// A bare greeting gets the fallback summaries.
+	llm.PushText("嗨").PushText("大家好")
+	handleEvent(ctx, groupTextEvent(gID, uID, "hi"), time.Now())
+
+	calls := llm.Calls()
+	if len(calls) != 2 {
+		t.Fatalf("made %d model calls, want 2", len(calls))
+	}
+	for _, call := range calls {
+		if len(call.History) != 0 {
+			t.Errorf("group chat started from the personal history %v", call.History)
+		}
+	}
+	fallback, _ := calls[1].Parts[0].(genai.Text)
+	if strings.Contains(string(fallback), "999") || !strings.Contains(string(fallback), "321") {
+		t.Errorf("fallback summaries %s, want the group entries only", fallback)
+	}
+
+	h, err := GetChatHistory(ctx, uID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Summary != personal.Summary || len(h.Turns) != len(personal.Turns) {
+		t.Errorf("group exchange written to the personal history: %+v", h)
+	}
+
+	// The summary tool counts the group entries only as well.
+	groupCtx := withGroup(ctx, gID)
+	resp, _ := groupTools.Dispatch(groupCtx, uID, genai.FunctionCall{Name: "getSummary", Args: map[string]any{"period": PeriodDay}})
+	if s, ok := resp.Response["summary"].(Summary); !ok || s.Calories != 321 {
+		t.Errorf("group summary %v, want 321 kcal", resp.Response)
+	}
+	if got := budgetText(groupCtx, uID, userNow(ctx, uID).Format(dayLayout)); !strings.Contains(got, "321") || strings.Contains(got, "999") {
+		t.Errorf("group budget %q", got)
+	}
+}
+
+func TestGroupUndoKeepsPersonalEntries(t *testing.T) {
+	useTestStore(t)
+	line := useFakeLINE(t)
+	useBotUserID(t)
+	useFakeLLM(t)
+	ctx := context.Background()
+	uID, gID := "Ualice", "Gfamily"
+
+	recordCalorie(ctx, uID, "秘密炸雞", "", 900, "", Nutrients{})
+	handleEvent(ctx, groupTextEvent(gID, uID, "undo"), time.Now())
+	if msg := line.lastMessage(t); msg.Text != "目前沒有可以復原的動作。" {
+		t.Errorf("group undo replied %q", msg.Text)
+	}
+
+	// The group action is undone, the personal one made later stays.
+	recordCalorie(withGroup(ctx, gID), uID, "火鍋", "", 321, "", Nutrients{})
+	recordCalorie(ctx, uID, "宵夜", "", 500, "", Nutrients{})
+	handleEvent(ctx, groupTextEvent(gID, uID, "undo"), time.Now())
+	msg := line.lastMessage(t)
+	if !strings.Contains(msg.Text, "火鍋") || strings.Contains(msg.Text, "炸雞") || strings.Contains(msg.Text, "宵夜") {
+		t.Errorf("group undo replied %q", msg.Text)
+	}
+
+	foods, err := GetFoods(ctx, uID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range foods {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "宵夜,秘密炸雞" {
+		t.Errorf("kept %v, want the personal entries only", names)
+	}
+
+	// The personal chat still undoes its own last action.
+	if got := undoLast(ctx, uID); !strings.Contains(got, "宵夜") {
+		t.Errorf("personal undo replied %q", got)
+	}
+}
+
+func TestPersonalChatRemembers(t *testing.T) {
+	useTestStore(t)
+	useFakeLINE(t)
+	llm := useFakeLLM(t)
+	ctx := context.Background()
+	uID := "Ualice"
+	seedFood(t, uID, "Gfamily", "火鍋", 321)
+	seedFood(t, uID, "", "炸雞", 999)
+
+	llm.PushText("嗨").PushText("你好")
+	handleEvent(ctx, textEvent(uID, "hi"), time.Now())
+
+	fallback, _ := llm.Calls()[1].Parts[0].(genai.Text)
+	if !strings.Contains(string(fallback), "1320") {
+		t.Errorf("fallback summaries %s, want every entry", fallback)
+	}
+	h, err := GetChatHistory(ctx, uID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Turns) != 1 || h.Turns[0].User != "hi" {
+		t.Errorf("personal history %+v, want the exchange", h)
+	}
+}
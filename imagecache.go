@@ -0,0 +1,203 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// Default sizing of the image cache.
+const (
+	DefaultImageCacheBytes = 64 << 20
+	DefaultImageCacheTTL   = 24 * time.Hour
+)
+
+// cachedImage is an entry of the in-memory image cache.
+type cachedImage struct {
+	id    string
+	data  []byte
+	added time.Time
+}
+
+// ImageCache keeps the images users sent, keyed by LINE message ID, so the
+// calc and cook postbacks do not download them again from LINE, whose
+// content expires. Recent images stay in an in-memory LRU and, when dir is
+// set, on disk.
+type ImageCache struct {
+	maxBytes int
+	ttl      time.Duration
+	dir      string
+
+	mu    sync.Mutex
+	bytes int
+	order *list.List
+	items map[string]*list.Element
+}
+
+// images is the image cache used by the bot.
+var images *ImageCache
+
+// NewImageCache creates a cache holding images of up to maxBytes in total
+// in memory for ttl. dir may be empty to keep images in memory only.
+func NewImageCache(maxBytes int, ttl time.Duration, dir string) *ImageCache {
+	if maxBytes <= 0 {
+		maxBytes = DefaultImageCacheBytes
+	}
+	if ttl <= 0 {
+		ttl = DefaultImageCacheTTL
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			log.Println("Image cache dir err:", err)
+			dir = ""
+		}
+	}
+	return &ImageCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		dir:      dir,
+		order:    list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+// Get returns the cached image of a message.
+func (c *ImageCache) Get(id string) ([]byte, bool) {
+	c.mu.Lock()
+	if e, ok := c.items[id]; ok {
+		img := e.Value.(*cachedImage)
+		if time.Since(img.added) < c.ttl {
+			c.order.MoveToFront(e)
+			c.mu.Unlock()
+			return img.data, true
+		}
+		c.remove(e)
+	}
+	c.mu.Unlock()
+
+	path, ok := c.file(id)
+	if !ok {
+		return nil, false
+	}
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) >= c.ttl {
+		return nil, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Println("Image cache read err:", err)
+		return nil, false
+	}
+	c.putMemory(id, data, info.ModTime())
+	return data, true
+}
+
+// Put caches the image of a message.
+func (c *ImageCache) Put(id string, data []byte) {
+	c.putMemory(id, data, time.Now())
+	if path, ok := c.file(id); ok {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			log.Println("Image cache write err:", err)
+		}
+	}
+}
+
+// Delete removes the image of a message from memory and disk.
+func (c *ImageCache) Delete(id string) {
+	c.mu.Lock()
+	if e, ok := c.items[id]; ok {
+		c.remove(e)
+	}
+	c.mu.Unlock()
+	if path, ok := c.file(id); ok {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Println("Image cache delete err:", err)
+		}
+	}
+}
+
+// Sweep removes the expired images from disk.
+func (c *ImageCache) Sweep() {
+	if c.dir == "" {
+		return
+	}
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Println("Image cache sweep err:", err)
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < c.ttl {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, entry.Name())); err != nil {
+			log.Println("Image cache sweep err:", err)
+		}
+	}
+}
+
+// SweepEvery runs Sweep periodically in the background.
+func (c *ImageCache) SweepEvery(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			c.Sweep()
+		}
+	}()
+}
+
+func (c *ImageCache) putMemory(id string, data []byte, added time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[id]; ok {
+		c.remove(e)
+	}
+	c.items[id] = c.order.PushFront(&cachedImage{id: id, data: data, added: added})
+	c.bytes += len(data)
+	// Keep the newest image even when it alone is over the limit.
+	for c.bytes > c.maxBytes && c.order.Len() > 1 {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove drops an entry from memory, c.mu must be held.
+func (c *ImageCache) remove(e *list.Element) {
+	img := c.order.Remove(e).(*cachedImage)
+	c.bytes -= len(img.data)
+	delete(c.items, img.id)
+}
+
+// file returns the disk path of a message image, if the disk store is on.
+func (c *ImageCache) file(id string) (string, bool) {
+	if c.dir == "" || id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", false
+	}
+	return filepath.Join(c.dir, id+".img"), true
+}
+
+// errNoImage is returned when an image is neither cached nor on LINE.
+var errNoImage = errors.New("image content not found")
+
+// getImage: Get the image of a message from the cache, downloading it from
+// LINE on a miss.
+func getImage(blob *messaging_api.MessagingApiBlobAPI, messageID string) ([]byte, error) {
+	if data, ok := images.Get(messageID); ok {
+		return data, nil
+	}
+	data, err := GetImageBinary(blob, messageID)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errNoImage
+	}
+	images.Put(messageID, data)
+	return data, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestImageCacheEvictsByBytes(t *testing.T) {
+	c := NewImageCache(100, time.Hour, "")
+	c.Put("m1", bytes.Repeat([]byte{1}, 40))
+	c.Put("m2", bytes.Repeat([]byte{2}, 40))
+	if _, ok := c.Get("m1"); !ok {
+		t.Fatal("m1 evicted under the limit")
+	}
+	// m2 is now the least recently used and goes to make room for m3.
+	c.Put("m3", bytes.Repeat([]byte{3}, 40))
+	if _, ok := c.Get("m2"); ok {
+		t.Error("m2 still cached over the limit")
+	}
+	for _, id := range []string{"m1", "m3"} {
+		if _, ok := c.Get(id); !ok {
+			t.Errorf("%s evicted, want the recent images kept", id)
+		}
+	}
+
+	// An image over the limit alone is still kept until the next one.
+	c.Put("big", bytes.Repeat([]byte{4}, 150))
+	if _, ok := c.Get("big"); !ok {
+		t.Error("big image not cached")
+	}
+	if _, ok := c.Get("m3"); ok {
+		t.Error("m3 still cached next to the big image")
+	}
+	c.Put("m4", bytes.Repeat([]byte{5}, 10))
+	if _, ok := c.Get("big"); ok {
+		t.Error("big image still cached over the limit")
+	}
+	if c.bytes != 10 {
+		t.Errorf("cache holds %d bytes, want 10", c.bytes)
+	}
+}
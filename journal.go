@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// DBJournalPath is the path to the per-user action journals in the database
+const DBJournalPath = "journal"
+
+// JournalSize is how many actions of a user can be undone.
+const JournalSize = 20
+
+// Journal operations on a food record.
+const (
+	OpInsert = "insert"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// journalChange is a write to one food record.
+type journalChange struct {
+	Op     string `json:"op"`
+	Key    string `json:"key"`
+	Before *Food  `json:"before,omitempty"`
+	// Day is the local date of an inserted record, which has no Before.
+	Day string `json:"day,omitempty"`
+}
+
+// journalEntry is one user action, which may write several food records,
+// such as all the dishes of a photo.
+type journalEntry struct {
+	Action  string          `json:"action"`
+	Changes []journalChange `json:"changes"`
+	Time    int64           `json:"time"`
+	GroupID string          `json:"groupId,omitempty"` // group chat the action was made in
+}
+
+// undoKeywords are the chat messages asking to undo the last action.
+var undoKeywords = []string{"undo", "復原", "還原", "取消上一步"}
+
+// userJournalPath returns the path of the action journal of a user.
+func userJournalPath(uID string) string {
+	return fmt.Sprintf("%s/%s", DBJournalPath, uID)
+}
+
+// journalBatch collects the actions of a single user message, such as the
+// tool calls of one chat message, so they are undone together.
+type journalBatch struct {
+	actions []string
+	changes []journalChange
+}
+
+// journalBatchKey is the context key of the pending journal batch.
+type journalBatchKey struct{}
+
+// withJournalBatch: Collect the journal actions made with the context into
+// a batch, written by its flush.
+func withJournalBatch(ctx context.Context) (context.Context, *journalBatch) {
+	b := &journalBatch{}
+	return context.WithValue(ctx, journalBatchKey{}, b), b
+}
+
+// flush: Record the collected actions as a single action of the user.
+func (b *journalBatch) flush(ctx context.Context, uID string) {
+	if len(b.changes) == 0 {
+		return
+	}
+	writeJournal(ctx, uID, strings.Join(b.actions, "、"), b.changes)
+	b.actions, b.changes = nil, nil
+}
+
+// journal: Record an action of the user so it can be undone, keeping the
+// latest JournalSize actions. Within a batch, the action is recorded when
+// the batch is flushed.
+func journal(ctx context.Context, uID, action string, changes ...journalChange) {
+	if len(changes) == 0 {
+		return
+	}
+	if b, ok := ctx.Value(journalBatchKey{}).(*journalBatch); ok {
+		b.actions = append(b.actions, action)
+		b.changes = append(b.changes, changes...)
+		return
+	}
+	writeJournal(ctx, uID, action, changes)
+}
+
+// writeJournal: Store an action in the journal and trim the oldest ones.
+func writeJournal(ctx context.Context, uID, action string, changes []journalChange) {
+	entry := journalEntry{Action: action, Changes: changes, Time: time.Now().Unix(), GroupID: groupOf(ctx)}
+	if _, err := foodDB.InsertDB(ctx, userJournalPath(uID), entry); err != nil {
+		log.Println("Journal save err:", err)
+		return
+	}
+
+	keys, _, err := journalKeys(ctx, uID)
+	if err != nil {
+		log.Println("Journal read err:", err)
+		return
+	}
+	for len(keys) > JournalSize {
+		if err := foodDB.DeleteDB(ctx, fmt.Sprintf("%s/%s", userJournalPath(uID), keys[0])); err != nil {
+			log.Println("Journal trim err:", err)
+		}
+		keys = keys[1:]
+	}
+}
+
+// journalKeys: Get the journal of a user with its keys oldest first.
+func journalKeys(ctx context.Context, uID string) ([]string, map[string]journalEntry, error) {
+	var entries map[string]journalEntry
+	if err := foodDB.GetFromDB(ctx, userJournalPath(uID), &entries); err != nil {
+		return nil, nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, entries, nil
+}
+
+// undoLast: Reverse the most recent action of the user. In a group chat
+// only the actions made in that group can be undone, the personal ones are
+// not even shown.
+func undoLast(ctx context.Context, uID string) string {
+	keys, entries, err := journalKeys(ctx, uID)
+	if err != nil {
+		log.Println("Journal read err:", err)
+		return "無法復原，請稍後再試。"
+	}
+	if gID := groupOf(ctx); gID != "" {
+		keys = slices.DeleteFunc(keys, func(k string) bool { return entries[k].GroupID != gID })
+	}
+	if len(keys) == 0 {
+		return "目前沒有可以復原的動作。"
+	}
+	key := keys[len(keys)-1]
+	entry := entries[key]
+
+	// Reverse the changes last first.
+	for i := len(entry.Changes) - 1; i >= 0; i-- {
+		c := entry.Changes[i]
+		var err error
+		switch c.Op {
+		case OpInsert:
+			err = DeleteFood(ctx, uID, c.Key)
+		case OpUpdate, OpDelete:
+			if c.Before != nil {
+				err = UpdateFood(ctx, uID, c.Key, *c.Before)
+			}
+		}
+		if err != nil {
+			log.Println("Undo err:", err)
+			return "無法復原，請稍後再試。"
+		}
+	}
+	if err := foodDB.DeleteDB(ctx, fmt.Sprintf("%s/%s", userJournalPath(uID), key)); err != nil {
+		log.Println("Journal delete err:", err)
+	}
+
+	// Show the budget of the day the action changed.
+	c := entry.Changes[0]
+	day := c.Day
+	if c.Before != nil {
+		day = foodDay(*c.Before)
+	}
+	if day == "" {
+		day = userNow(ctx, uID).Format(dayLayout)
+	}
+	return fmt.Sprintf("已復原: %s\n\n%s", entry.Action, budgetText(ctx, uID, day))
+}
+
+// isUndo reports whether a chat message asks to undo the last action.
+func isUndo(text string) bool {
+	text = strings.ToLower(strings.TrimSpace(text))
+	for _, k := range undoKeywords {
+		if text == k {
+			return true
+		}
+	}
+	return false
+}
+
+// undoQuickReplyItem: The button undoing the last action.
+func undoQuickReplyItem() messaging_api.QuickReplyItem {
+	return messaging_api.QuickReplyItem{
+		Action: &messaging_api.PostbackAction{
+			Label:       "復原",
+			Data:        "action=undo",
+			DisplayText: "復原上一步",
+		},
+	}
+}
+
+// undoQuickReply: Quick reply offering to undo the last action.
+func undoQuickReply() *messaging_api.QuickReply {
+	return &messaging_api.QuickReply{
+		Items: []messaging_api.QuickReplyItem{undoQuickReplyItem()},
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestUndoInsertShowsItsDay(t *testing.T) {
+	useTestStore(t)
+	ctx := context.Background()
+	uID := "Ualice"
+	if err := SaveProfile(ctx, uID, Profile{TimeZone: "Asia/Taipei"}); err != nil {
+		t.Fatal(err)
+	}
+	now := userNow(ctx, uID)
+	yesterday := now.AddDate(0, 0, -1).Format(dayLayout)
+	today := now.Format(dayLayout)
+
+	recordCalorie(ctx, uID, "牛肉麵", today, 700, "", Nutrients{})
+	recordCalorie(ctx, uID, "蛋糕", yesterday, 400, "", Nutrients{})
+
+	answer := undoLast(ctx, uID)
+	if !strings.Contains(answer, "📊 "+yesterday+" 已攝取 0 大卡") {
+		t.Errorf("undo answered %q, want the budget of %s", answer, yesterday)
+	}
+	foods, err := GetFoods(ctx, uID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(foods) != 1 {
+		t.Fatalf("kept %d entries, want 1", len(foods))
+	}
+	for _, f := range foods {
+		if f.Name != "牛肉麵" {
+			t.Errorf("kept %s, want 牛肉麵", f.Name)
+		}
+	}
+
+	// Journals written before the day was kept fall back to today.
+	journal(ctx, uID, "舊紀錄", journalChange{Op: OpInsert, Key: "gone"})
+	if answer := undoLast(ctx, uID); !strings.Contains(answer, today) {
+		t.Errorf("undo answered %q, want the budget of %s", answer, today)
+	}
+}
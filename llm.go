@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// LLM providers selectable by LLM_PROVIDER.
+const (
+	ProviderGemini = "gemini"
+	ProviderFake   = "fake"
+)
+
+// LLM is the generative model used by the bot.
+type LLM interface {
+	// GeminiImage answers a prompt about an image.
+	GeminiImage(ctx context.Context, imgData []byte, prompt string) (string, error)
+	// GeminiImageJSON answers a prompt about an image with JSON following
+	// the schema.
+	GeminiImageJSON(ctx context.Context, imgData []byte, prompt string, schema *genai.Schema) (string, error)
+	// GeminiChatComplete answers a single text prompt.
+	GeminiChatComplete(ctx context.Context, req string) (string, error)
+	// StartChat starts a chat session able to call the given tools,
+	// continuing from the history.
+	StartChat(history []*genai.Content, tools []*genai.Tool) ChatSession
+	// Close releases the provider.
+	Close() error
+}
+
+// ChatSession is a multi-turn conversation with the model. It is satisfied
+// by *genai.ChatSession.
+type ChatSession interface {
+	SendMessage(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error)
+}
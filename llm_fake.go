@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// FakeDefaultAnswer is returned by FakeLLM once its script is exhausted.
+const FakeDefaultAnswer = "好的，已經收到。"
+
+// FakeCall is a request received by FakeLLM.
+type FakeCall struct {
+	Method string
+	Parts  []genai.Part
+	// History is the history the chat session started from.
+	History []*genai.Content
+}
+
+// FakeLLM is a deterministic LLM answering from a script of canned
+// responses, so the bot runs without network access. Every call, whichever
+// method it goes through, consumes the next scripted response, unless its
+// context is already done.
+type FakeLLM struct {
+	mu     sync.Mutex
+	script []fakeAnswer
+	calls  []FakeCall
+}
+
+// fakeAnswer is a scripted response, or the error of a failed call.
+type fakeAnswer struct {
+	resp *genai.GenerateContentResponse
+	err  error
+}
+
+// NewFakeLLM creates a FakeLLM with an empty script.
+func NewFakeLLM() *FakeLLM {
+	return &FakeLLM{}
+}
+
+// PushText scripts a plain text answer.
+func (f *FakeLLM) PushText(text string) *FakeLLM {
+	return f.push(genai.Text(text))
+}
+
+// PushJSON scripts an answer holding v encoded as JSON.
+func (f *FakeLLM) PushJSON(v any) *FakeLLM {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		panic(fmt.Sprintf("fake llm: %v", err))
+	}
+	return f.push(genai.Text(raw))
+}
+
+// PushFunctionCall scripts an answer asking to call a tool.
+func (f *FakeLLM) PushFunctionCall(name string, args map[string]any) *FakeLLM {
+	return f.push(genai.FunctionCall{Name: name, Args: args})
+}
+
+// PushFunctionCalls scripts an answer asking to call several tools at once.
+func (f *FakeLLM) PushFunctionCalls(calls ...genai.FunctionCall) *FakeLLM {
+	parts := make([]genai.Part, 0, len(calls))
+	for _, call := range calls {
+		parts = append(parts, call)
+	}
+	return f.push(parts...)
+}
+
+// PushError scripts a failed call.
+func (f *FakeLLM) PushError(err error) *FakeLLM {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = append(f.script, fakeAnswer{err: err})
+	return f
+}
+
+// Calls returns the requests received so far.
+func (f *FakeLLM) Calls() []FakeCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeCall(nil), f.calls...)
+}
+
+func (f *FakeLLM) push(parts ...genai.Part) *FakeLLM {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.script = append(f.script, fakeAnswer{resp: &genai.GenerateContentResponse{
+		Candidates: []*genai.Candidate{{
+			Content: &genai.Content{Role: "model", Parts: parts},
+		}},
+	}})
+	return f
+}
+
+// next records a call and pops the next scripted response.
+func (f *FakeLLM) next(ctx context.Context, method string, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	return f.nextIn(ctx, FakeCall{Method: method, Parts: parts})
+}
+
+// nextIn records the call and pops the next scripted response.
+func (f *FakeLLM) nextIn(ctx context.Context, call FakeCall) (*genai.GenerateContentResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(f.script) == 0 {
+		return &genai.GenerateContentResponse{
+			Candidates: []*genai.Candidate{{
+				Content: &genai.Content{Role: "model", Parts: []genai.Part{genai.Text(FakeDefaultAnswer)}},
+			}},
+		}, nil
+	}
+	answer := f.script[0]
+	f.script = f.script[1:]
+	return answer.resp, answer.err
+}
+
+// GeminiImage answers with the next scripted response.
+func (f *FakeLLM) GeminiImage(ctx context.Context, imgData []byte, prompt string) (string, error) {
+	resp, err := f.next(ctx, "GeminiImage", genai.ImageData("png", imgData), genai.Text(prompt))
+	return printResponse(resp), err
+}
+
+// GeminiImageJSON answers with the next scripted response.
+func (f *FakeLLM) GeminiImageJSON(ctx context.Context, imgData []byte, prompt string, schema *genai.Schema) (string, error) {
+	resp, err := f.next(ctx, "GeminiImageJSON", genai.ImageData("png", imgData), genai.Text(prompt))
+	return printResponse(resp), err
+}
+
+// GeminiChatComplete answers with the next scripted response.
+func (f *FakeLLM) GeminiChatComplete(ctx context.Context, req string) (string, error) {
+	resp, err := f.next(ctx, "GeminiChatComplete", genai.Text(req))
+	return printResponse(resp), err
+}
+
+// StartChat starts a session answering from the same script.
+func (f *FakeLLM) StartChat(history []*genai.Content, tools []*genai.Tool) ChatSession {
+	return &fakeChatSession{llm: f, history: history}
+}
+
+// Close does nothing.
+func (f *FakeLLM) Close() error {
+	return nil
+}
+
+// fakeChatSession is the ChatSession of FakeLLM.
+type fakeChatSession struct {
+	llm     *FakeLLM
+	history []*genai.Content
+}
+
+// SendMessage answers with the next scripted response.
+func (s *fakeChatSession) SendMessage(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	return s.llm.nextIn(ctx, FakeCall{Method: "SendMessage", Parts: parts, History: s.history})
+}
@@ -18,6 +18,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
 )
@@ -28,17 +30,16 @@ var channelToken string
 
 var bot *messaging_api.MessagingApiAPI
 var blob *messaging_api.MessagingApiBlobAPI
-var gemini *GeminiApp
+var gemini LLM
 
 func main() {
 	var err error
 	geminiKey = os.Getenv("GOOGLE_GEMINI_API_KEY")
 	channelToken = os.Getenv("ChannelAccessToken")
-	gaeKey := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
-	firebaseURL := os.Getenv("FIREBASE_URL")
 
-	//Init firebase
-	initFirebase(gaeKey, firebaseURL, context.Background())
+	// Init storage backend, firebase by default.
+	closeStore := initStore()
+	defer closeStore()
 
 	// initialize the messaging API
 	bot, err = messaging_api.NewMessagingApiAPI(channelToken)
@@ -46,16 +47,73 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Initialize the Gemini API
-	gemini = InitGemini(geminiKey)
-	defer gemini.client.Close()
+	// Initialize the Gemini API, or the canned fake for offline runs.
+	switch provider := os.Getenv("LLM_PROVIDER"); provider {
+	case "", ProviderGemini:
+		gemini = InitGemini(geminiKey)
+	case ProviderFake:
+		gemini = NewFakeLLM()
+	default:
+		log.Fatalf("unknown LLM_PROVIDER: %s", provider)
+	}
+	defer gemini.Close()
+
+	// Find the bot's own IDs to answer its mentions in groups and link to
+	// its add friend page.
+	if info, err := bot.GetBotInfo(); err != nil {
+		log.Println("Get bot info err:", err)
+	} else {
+		botUserID = info.UserId
+		botBasicID = info.BasicId
+	}
 
 	blob, err = messaging_api.NewMessagingApiBlobAPI(channelToken)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Convert the dates of records saved before timestamps.
+	if os.Getenv("MIGRATE_FOOD_DATES") == "true" {
+		if err := migrateAllFoods(context.Background()); err != nil {
+			log.Println("Migrate food dates err:", err)
+		}
+	}
+
+	// Remember processed webhook events to skip redeliveries.
+	dedup = NewEventDedup(foodDB, DefaultEventTTL)
+	dedup.SweepEvery(time.Hour)
+
+	// Keep the received images for the calc and cook postbacks.
+	cacheMB, _ := strconv.Atoi(os.Getenv("IMAGE_CACHE_MB"))
+	images = NewImageCache(cacheMB<<20, DefaultImageCacheTTL, os.Getenv("IMAGE_CACHE_DIR"))
+	images.SweepEvery(time.Hour)
+
+	// Delete the data of the users who unfollowed the bot.
+	if days, err := strconv.Atoi(os.Getenv("DATA_RETENTION_DAYS")); err == nil && days >= 0 {
+		retentionPeriod = time.Duration(days) * 24 * time.Hour
+	}
+	PurgeEvery(time.Hour)
+
+	// Remember the recent chat of each user.
+	if n, err := strconv.Atoi(os.Getenv("CHAT_HISTORY_WINDOW")); err == nil && n >= 0 {
+		chatWindow = n
+	}
+
+	// Start the workers handling webhook events.
+	workers, _ := strconv.Atoi(os.Getenv("WORKER_COUNT"))
+	queueSize, _ := strconv.Atoi(os.Getenv("QUEUE_SIZE"))
+	events = NewEventQueue(workers, queueSize, handleEvent)
+	defer events.Close()
+
+	// Serve the data exports through signed links.
+	baseURL = os.Getenv("BASE_URL")
+	exportSecret = os.Getenv("EXPORT_SECRET")
+	if exportSecret == "" {
+		exportSecret = os.Getenv("ChannelSecret")
+	}
+
 	http.HandleFunc("/callback", callbackHandler)
+	http.HandleFunc("/export", exportHandler)
 	port := os.Getenv("PORT")
 	addr := fmt.Sprintf(":%s", port)
 	http.ListenAndServe(addr, nil)
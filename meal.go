@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// Meal types of a food entry.
+const (
+	MealBreakfast = "breakfast"
+	MealLunch     = "lunch"
+	MealDinner    = "dinner"
+	MealSnack     = "snack"
+	// MealOther groups the entries whose meal cannot be told.
+	MealOther = "other"
+)
+
+// mealTypes lists the meal types a user can pick, in the order of a day.
+var mealTypes = []string{MealBreakfast, MealLunch, MealDinner, MealSnack}
+
+// mealNames are the display names of the meal types.
+var mealNames = map[string]string{
+	MealBreakfast: "早餐",
+	MealLunch:     "午餐",
+	MealDinner:    "晚餐",
+	MealSnack:     "點心",
+	MealOther:     "其他",
+}
+
+// mealSchema describes the meal type argument of the tools.
+var mealSchema = &genai.Schema{
+	Type:        genai.TypeString,
+	Description: "The meal of the intake, only when the user tells it",
+	Format:      "enum",
+	Enum:        mealTypes,
+}
+
+// MealTotal is the sum of the entries of one meal type.
+type MealTotal struct {
+	Entries  int `json:"entries"`
+	Calories int `json:"calories"`
+}
+
+// validMeal reports whether meal is one of mealTypes.
+func validMeal(meal string) bool {
+	for _, m := range mealTypes {
+		if m == meal {
+			return true
+		}
+	}
+	return false
+}
+
+// inferMeal: Guess the meal type from the local time of eating.
+func inferMeal(t time.Time) string {
+	switch h := t.Hour(); {
+	case h >= 5 && h < 11:
+		return MealBreakfast
+	case h >= 11 && h < 15:
+		return MealLunch
+	case h >= 17 && h < 22:
+		return MealDinner
+	}
+	return MealSnack
+}
+
+// foodMeal: Get the meal type of an entry, inferred from its time when it
+// was saved without one.
+func foodMeal(f Food, loc *time.Location) string {
+	if f.Meal != "" {
+		return f.Meal
+	}
+	// A date without a time of day cannot tell the meal.
+	if f.Timestamp == "" {
+		return MealOther
+	}
+	if t, ok := foodTime(f, loc); ok {
+		return inferMeal(t)
+	}
+	return MealOther
+}
+
+// mealQuickReply: Quick reply buttons to correct the meal type of the
+// entries recorded from an image message.
+func mealQuickReply(messageID string) *messaging_api.QuickReply {
+	var items []messaging_api.QuickReplyItem
+	for _, meal := range mealTypes {
+		items = append(items, messaging_api.QuickReplyItem{
+			Action: &messaging_api.PostbackAction{
+				Label:       mealNames[meal],
+				Data:        fmt.Sprintf("action=meal&m_id=%s&meal=%s", messageID, meal),
+				DisplayText: "這是" + mealNames[meal],
+			},
+		})
+	}
+	return &messaging_api.QuickReply{Items: items}
+}
+
+// setMessageMeal: Set the meal type of the entries recorded from an image
+// message, returning how many were changed.
+func setMessageMeal(ctx context.Context, uID, messageID, meal string) (int, error) {
+	if !validMeal(meal) {
+		return 0, fmt.Errorf("unknown meal type: %s", meal)
+	}
+	foods, err := GetFoods(ctx, uID)
+	if err != nil {
+		return 0, err
+	}
+	var changes []journalChange
+	defer func() {
+		journal(ctx, uID, "標記為"+mealNames[meal], changes...)
+	}()
+	for key, f := range foods {
+		if f.MessageID != messageID {
+			continue
+		}
+		before := f
+		f.Meal = meal
+		if err := UpdateFood(ctx, uID, key, f); err != nil {
+			return len(changes), err
+		}
+		changes = append(changes, journalChange{Op: OpUpdate, Key: key, Before: &before})
+	}
+	return len(changes), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// DBChatPath is the path to the chat histories in the database
+const DBChatPath = "chat"
+
+// DefaultChatWindow is the number of exchanges kept word for word.
+const DefaultChatWindow = 10
+
+// chatWindow is the number of exchanges kept word for word, older ones are
+// folded into the summary. Zero turns the memory off.
+var chatWindow = DefaultChatWindow
+
+// SummaryPrompt asks the model to fold old exchanges into the summary.
+const SummaryPrompt = `請把以下與使用者的對話整理成一段簡短的摘要 (200 字以內)，保留使用者提到的飲食、份量、目標與偏好等之後對話會用到的資訊，不需要保留計算過的數字。
+
+先前的摘要:
+%s
+
+對話:
+%s`
+
+// ChatTurn is one exchange between the user and the bot.
+type ChatTurn struct {
+	User  string `json:"user"`
+	Model string `json:"model"`
+	Time  string `json:"time"`
+}
+
+// ChatHistory is the conversation memory of a user: a summary of the older
+// exchanges and the recent ones word for word.
+type ChatHistory struct {
+	Summary string     `json:"summary,omitempty"`
+	Turns   []ChatTurn `json:"turns,omitempty"`
+}
+
+// userChatPath returns the path of the chat history of a user.
+func userChatPath(uID string) string {
+	return fmt.Sprintf("%s/%s", DBChatPath, uID)
+}
+
+// GetChatHistory returns the chat history of the user, empty if none was
+// saved.
+func GetChatHistory(ctx context.Context, uID string) (ChatHistory, error) {
+	var h ChatHistory
+	err := foodDB.GetFromDB(ctx, userChatPath(uID), &h)
+	return h, err
+}
+
+// SaveChatHistory stores the chat history of the user.
+func SaveChatHistory(ctx context.Context, uID string, h ChatHistory) error {
+	return foodDB.SetDB(ctx, userChatPath(uID), h)
+}
+
+// Contents: The history as the contents seeding a chat session, the summary
+// first. Roles alternate between user and model as Gemini requires.
+func (h ChatHistory) Contents() []*genai.Content {
+	var contents []*genai.Content
+	add := func(user, model string) {
+		contents = append(contents,
+			&genai.Content{Role: "user", Parts: []genai.Part{genai.Text(user)}},
+			&genai.Content{Role: "model", Parts: []genai.Part{genai.Text(model)}},
+		)
+	}
+	if h.Summary != "" {
+		add("先前對話的摘要: "+h.Summary, "好的，我記得。")
+	}
+	for _, t := range h.Turns {
+		add(t.User, t.Model)
+	}
+	return contents
+}
+
+// remember: Add an exchange to the chat history of the user. Once the
+// window is full, the older half is folded into the summary, so the model
+// is asked for a summary every few exchanges rather than on each one.
+func remember(ctx context.Context, uID, user, model string) {
+	if chatWindow <= 0 || user == "" || model == "" {
+		return
+	}
+	h, err := GetChatHistory(ctx, uID)
+	if err != nil {
+		log.Println("Chat history read err:", err)
+		return
+	}
+	h.Turns = append(h.Turns, ChatTurn{
+		User:  user,
+		Model: model,
+		Time:  time.Now().UTC().Format(time.RFC3339),
+	})
+	if len(h.Turns) > chatWindow {
+		keep := chatWindow / 2
+		h = h.fold(ctx, len(h.Turns)-keep)
+	}
+	if len(h.Turns) > 2*chatWindow {
+		// The summary keeps failing, drop the oldest turns instead.
+		h.Turns = h.Turns[len(h.Turns)-2*chatWindow:]
+	}
+	if err := SaveChatHistory(ctx, uID, h); err != nil {
+		log.Println("Chat history save err:", err)
+	}
+}
+
+// fold: Summarize the first n turns together with the previous summary.
+func (h ChatHistory) fold(ctx context.Context, n int) ChatHistory {
+	var sb strings.Builder
+	for _, t := range h.Turns[:n] {
+		fmt.Fprintf(&sb, "使用者: %s\n機器人: %s\n", t.User, t.Model)
+	}
+	summary, err := gemini.GeminiChatComplete(ctx, fmt.Sprintf(SummaryPrompt, h.Summary, sb.String()))
+	if summary = strings.TrimSpace(summary); err != nil || summary == "" {
+		// Keep the turns rather than losing them, try again next time.
+		return h
+	}
+	return ChatHistory{
+		Summary: summary,
+		Turns:   append([]ChatTurn(nil), h.Turns[n:]...),
+	}
+}
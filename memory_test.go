@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// useChatWindow sets the chat window for the duration of the test.
+func useChatWindow(t *testing.T, n int) {
+	t.Helper()
+	prev := chatWindow
+	chatWindow = n
+	t.Cleanup(func() { chatWindow = prev })
+}
+
+func TestRememberFoldsOldTurns(t *testing.T) {
+	useTestStore(t)
+	useChatWindow(t, 4)
+	llm := useFakeLLM(t)
+	llm.PushText("使用者早餐吃了燒餅。")
+	ctx := context.Background()
+	uID := "Ualice"
+
+	for i := 1; i <= 5; i++ {
+		remember(ctx, uID, fmt.Sprintf("問題%d", i), fmt.Sprintf("回答%d", i))
+	}
+	if n := len(llm.Calls()); n != 1 {
+		t.Fatalf("asked the model %d times for a summary, want 1", n)
+	}
+	if prompt := fmt.Sprint(llm.Calls()[0].Parts); !strings.Contains(prompt, "問題3") || strings.Contains(prompt, "問題4") {
+		t.Errorf("summary prompt %q, want the first 3 turns only", prompt)
+	}
+
+	h, err := GetChatHistory(ctx, uID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Summary != "使用者早餐吃了燒餅。" {
+		t.Errorf("summary %q", h.Summary)
+	}
+	if len(h.Turns) != 2 || h.Turns[0].User != "問題4" || h.Turns[1].User != "問題5" {
+		t.Fatalf("kept turns %+v, want 問題4 and 問題5", h.Turns)
+	}
+
+	contents := h.Contents()
+	if len(contents) != 6 {
+		t.Fatalf("got %d contents, want 6", len(contents))
+	}
+	for i, c := range contents {
+		want := "user"
+		if i%2 == 1 {
+			want = "model"
+		}
+		if c.Role != want {
+			t.Errorf("content %d has role %q, want %q", i, c.Role, want)
+		}
+	}
+	if text, _ := contents[0].Parts[0].(genai.Text); !strings.Contains(string(text), h.Summary) {
+		t.Errorf("first content %q, want the summary", text)
+	}
+}
+
+func TestRememberCapsTurnsWhenSummaryFails(t *testing.T) {
+	useTestStore(t)
+	useChatWindow(t, 4)
+	llm := useFakeLLM(t)
+	for i := 0; i < 8; i++ {
+		llm.PushError(errors.New("quota exceeded"))
+	}
+	ctx := context.Background()
+	uID := "Ualice"
+
+	for i := 1; i <= 12; i++ {
+		remember(ctx, uID, fmt.Sprintf("問題%d", i), fmt.Sprintf("回答%d", i))
+	}
+	if n := len(llm.Calls()); n != 8 {
+		t.Errorf("asked the model %d times for a summary, want 8", n)
+	}
+
+	h, err := GetChatHistory(ctx, uID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Summary != "" {
+		t.Errorf("summary %q, want none", h.Summary)
+	}
+	if len(h.Turns) != 8 || h.Turns[0].User != "問題5" || h.Turns[7].User != "問題12" {
+		t.Errorf("kept %d turns from %q, want the last 8", len(h.Turns), h.Turns[0].User)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Nutrients are the macronutrients of a food entry, in grams except sodium
+// in milligrams. Records saved before macros were tracked load as zero.
+type Nutrients struct {
+	Protein float64 `json:"protein,omitempty"`
+	Carbs   float64 `json:"carbs,omitempty"`
+	Fat     float64 `json:"fat,omitempty"`
+	Fiber   float64 `json:"fiber,omitempty"`
+	Sugar   float64 `json:"sugar,omitempty"`
+	Sodium  float64 `json:"sodium,omitempty"`
+}
+
+// Add returns the sum of n and o.
+func (n Nutrients) Add(o Nutrients) Nutrients {
+	return Nutrients{
+		Protein: n.Protein + o.Protein,
+		Carbs:   n.Carbs + o.Carbs,
+		Fat:     n.Fat + o.Fat,
+		Fiber:   n.Fiber + o.Fiber,
+		Sugar:   n.Sugar + o.Sugar,
+		Sodium:  n.Sodium + o.Sodium,
+	}
+}
+
+// nutrientSchemas describes the Nutrients fields for Gemini schemas.
+var nutrientSchemas = map[string]*genai.Schema{
+	"protein": {Type: genai.TypeNumber, Description: "Protein in grams"},
+	"carbs":   {Type: genai.TypeNumber, Description: "Carbohydrate in grams"},
+	"fat":     {Type: genai.TypeNumber, Description: "Fat in grams"},
+	"fiber":   {Type: genai.TypeNumber, Description: "Dietary fiber in grams"},
+	"sugar":   {Type: genai.TypeNumber, Description: "Sugar in grams"},
+	"sodium":  {Type: genai.TypeNumber, Description: "Sodium in milligrams"},
+}
+
+// withNutrients returns props extended with the Nutrients fields.
+func withNutrients(props map[string]*genai.Schema) map[string]*genai.Schema {
+	for k, v := range nutrientSchemas {
+		props[k] = v
+	}
+	return props
+}
+
+// toNutrients: Read the Nutrients fields of a decoded JSON object.
+func toNutrients(item map[string]interface{}) Nutrients {
+	return Nutrients{
+		Protein: toNumber(item["protein"]),
+		Carbs:   toNumber(item["carbs"]),
+		Fat:     toNumber(item["fat"]),
+		Fiber:   toNumber(item["fiber"]),
+		Sugar:   toNumber(item["sugar"]),
+		Sodium:  toNumber(item["sodium"]),
+	}
+}
+
+// DailyTotal is the sum of the food entries of one day.
+type DailyTotal struct {
+	Date     string `json:"date"`
+	Calories int    `json:"calories"`
+	Nutrients
+}
+
+// dailyTotals: Sum the food entries per day, oldest day first.
+func dailyTotals(foods map[string]Food) []DailyTotal {
+	byDay := map[string]*DailyTotal{}
+	for _, f := range foods {
+		day := foodDay(f)
+		t, ok := byDay[day]
+		if !ok {
+			t = &DailyTotal{Date: day}
+			byDay[day] = t
+		}
+		t.Calories += f.Calories
+		t.Nutrients = t.Nutrients.Add(f.Nutrients)
+	}
+
+	totals := make([]DailyTotal, 0, len(byDay))
+	for _, t := range byDay {
+		totals = append(totals, *t)
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].Date < totals[j].Date })
+	return totals
+}
+
+// dailyTotal: Sum the food entries of the given day.
+func dailyTotal(foods map[string]Food, day string) DailyTotal {
+	for _, t := range dailyTotals(foods) {
+		if t.Date == day {
+			return t
+		}
+	}
+	return DailyTotal{Date: day}
+}
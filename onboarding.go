@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// Sexes of a profile.
+const (
+	SexMale   = "male"
+	SexFemale = "female"
+)
+
+// Answers accepted at every onboarding step.
+const (
+	SkipAnswer = "略過"
+	StopAnswer = "結束設定"
+)
+
+// numericAnswer matches an answer to a numeric question, such as "30" or
+// "170 公分".
+var numericAnswer = regexp.MustCompile(`(?i)^\d+(\.\d+)?\s*(歲|公分|公斤|cm|kg)?$`)
+
+// onboardingKeywords restart the onboarding questionnaire.
+var onboardingKeywords = []string{"設定個人資料", "個人資料設定", "重新設定"}
+
+// activityLevel is an answer to the activity question, with its factor on
+// the basal metabolic rate.
+type activityLevel struct {
+	Name   string
+	Label  string
+	Factor float64
+}
+
+// activityLevels are the activity levels, from the least active.
+var activityLevels = []activityLevel{
+	{"sedentary", "久坐少動", 1.2},
+	{"light", "每週運動 1-3 天", 1.375},
+	{"moderate", "每週運動 3-5 天", 1.55},
+	{"active", "每週運動 6-7 天", 1.725},
+	{"veryActive", "勞力工作或每天訓練", 1.9},
+}
+
+// dietOptions are the suggested dietary preferences.
+var dietOptions = []string{"無特殊", "素食", "蛋奶素", "低碳水", "生酮", "無麩質", "乳糖不耐"}
+
+// DietTagMaxLen is the longest dietary preference typed in, in characters.
+// Longer text, like a meal, is not an answer to the diet question.
+const DietTagMaxLen = 6
+
+// dietTag reports whether a typed word reads as a dietary preference: a
+// suggested one, or a short tag without numbers or eating verbs.
+func dietTag(tag string) bool {
+	if slices.Contains(dietOptions, tag) {
+		return true
+	}
+	return utf8.RuneCountInString(tag) <= DietTagMaxLen && !strings.ContainsAny(tag, "0123456789吃喝")
+}
+
+// timeZoneOptions are the suggested time zones by label.
+var timeZoneOptions = []struct{ Label, Name string }{
+	{"台灣", "Asia/Taipei"},
+	{"香港", "Asia/Hong_Kong"},
+	{"日本", "Asia/Tokyo"},
+	{"新加坡", "Asia/Singapore"},
+	{"美國西岸", "America/Los_Angeles"},
+	{"美國東岸", "America/New_York"},
+	{"英國", "Europe/London"},
+}
+
+// onboardingStep is a question of the onboarding questionnaire. apply
+// stores the answer on the profile and reports whether it was understood.
+// A numeric question takes a bare number, other text is not an answer.
+type onboardingStep struct {
+	Name     string
+	Question string
+	Options  []string
+	Numeric  bool
+	apply    func(p *Profile, answer string) bool
+}
+
+// onboardingSteps are the questions asked after the user adds the bot, in
+// order.
+var onboardingSteps = []onboardingStep{
+	{
+		Name:     "age",
+		Question: "請問你的年齡是？(例如: 30)",
+		Numeric:  true,
+		apply: func(p *Profile, answer string) bool {
+			age := int(toNumber(answer))
+			if age < 10 || age > 120 {
+				return false
+			}
+			p.Age = age
+			return true
+		},
+	}, {
+		Name:     "sex",
+		Question: "請問你的生理性別是？(用來估算基礎代謝率)",
+		Options:  []string{"男", "女"},
+		apply: func(p *Profile, answer string) bool {
+			switch answer {
+			case "男", "男性", "male":
+				p.Sex = SexMale
+			case "女", "女性", "female":
+				p.Sex = SexFemale
+			default:
+				return false
+			}
+			return true
+		},
+	}, {
+		Name:     "height",
+		Question: "請問你的身高是幾公分？(例如: 170)",
+		Numeric:  true,
+		apply: func(p *Profile, answer string) bool {
+			h := toNumber(answer)
+			if h < 100 || h > 250 {
+				return false
+			}
+			p.HeightCm = h
+			return true
+		},
+	}, {
+		Name:     "weight",
+		Question: "請問你的體重是幾公斤？(例如: 65)",
+		Numeric:  true,
+		apply: func(p *Profile, answer string) bool {
+			w := toNumber(answer)
+			if w < 25 || w > 300 {
+				return false
+			}
+			p.WeightKg = w
+			return true
+		},
+	}, {
+		Name:     "activity",
+		Question: "平常的活動量大約是？",
+		Options:  activityLabels(),
+		apply: func(p *Profile, answer string) bool {
+			for _, a := range activityLevels {
+				if answer == a.Label {
+					p.Activity = a.Name
+					return true
+				}
+			}
+			return false
+		},
+	}, {
+		Name:     "diet",
+		Question: "有沒有飲食偏好或限制？可以選擇或直接輸入，多個請用頓號分開。",
+		Options:  dietOptions,
+		apply: func(p *Profile, answer string) bool {
+			tags := strings.FieldsFunc(answer, func(r rune) bool { return strings.ContainsRune("、,，/ ", r) })
+			if len(tags) == 0 || slices.ContainsFunc(tags, func(d string) bool { return !dietTag(d) }) {
+				return false
+			}
+			p.Diet = nil
+			for _, d := range tags {
+				if d != dietOptions[0] {
+					p.Diet = append(p.Diet, d)
+				}
+			}
+			return true
+		},
+	}, {
+		Name:     "timeZone",
+		Question: "最後，你所在的時區是？也可以輸入時區名稱，例如 Asia/Taipei。",
+		Options:  timeZoneLabels(),
+		apply: func(p *Profile, answer string) bool {
+			name := answer
+			for _, tz := range timeZoneOptions {
+				if answer == tz.Label {
+					name = tz.Name
+				}
+			}
+			if !validTimeZone(name) {
+				return false
+			}
+			p.TimeZone = name
+			return true
+		},
+	},
+}
+
+// activityLabels: The answers to the activity question.
+func activityLabels() []string {
+	var labels []string
+	for _, a := range activityLevels {
+		labels = append(labels, a.Label)
+	}
+	return labels
+}
+
+// timeZoneLabels: The suggested answers to the time zone question.
+func timeZoneLabels() []string {
+	var labels []string
+	for _, tz := range timeZoneOptions {
+		labels = append(labels, tz.Label)
+	}
+	return labels
+}
+
+// findStep: Get the index of the onboarding step by name.
+func findStep(name string) (int, bool) {
+	for i, s := range onboardingSteps {
+		if s.Name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// isOnboarding reports whether the text asks to fill in the profile again.
+func isOnboarding(text string) bool {
+	text = strings.TrimSpace(text)
+	for _, k := range onboardingKeywords {
+		if text == k {
+			return true
+		}
+	}
+	return false
+}
+
+// startOnboarding: Start the questionnaire and get its first question.
+func startOnboarding(ctx context.Context, uID string) (string, *messaging_api.QuickReply) {
+	p, err := GetProfile(ctx, uID)
+	if err != nil {
+		log.Println("Profile read err:", err)
+	}
+	p.Onboarding = onboardingSteps[0].Name
+	if err := SaveProfile(ctx, uID, p); err != nil {
+		log.Println("Profile save err:", err)
+		return "歡迎使用美食小幫手！傳送食物照片或告訴我你吃了什麼，我就會幫你記錄。", nil
+	}
+	text, qReply := onboardingSteps[0].ask()
+	return "歡迎使用美食小幫手！先問你幾個問題，幫你算出建議的每日熱量。隨時可以回答「略過」跳過問題。\n\n" + text, qReply
+}
+
+// ask: The question of the step with its quick reply buttons.
+func (s onboardingStep) ask() (string, *messaging_api.QuickReply) {
+	var items []messaging_api.QuickReplyItem
+	for _, o := range append(append([]string(nil), s.Options...), SkipAnswer, StopAnswer) {
+		if len(items) == QuickReplyMaxItems {
+			break
+		}
+		items = append(items, messaging_api.QuickReplyItem{
+			Action: &messaging_api.MessageAction{Label: o, Text: o},
+		})
+	}
+	return s.Question, &messaging_api.QuickReply{Items: items}
+}
+
+// onboard: Take the answer to the pending onboarding question and ask the
+// next one. Reports false when the user is not onboarding, or the text does
+// not answer the question, such as a meal to record: the text is handled as
+// usual and the question stays pending.
+func onboard(ctx context.Context, uID, text string) (string, *messaging_api.QuickReply, bool) {
+	p, err := GetProfile(ctx, uID)
+	if err != nil || p.Onboarding == "" {
+		return "", nil, false
+	}
+	i, ok := findStep(p.Onboarding)
+	if !ok {
+		p.Onboarding = ""
+		if err := SaveProfile(ctx, uID, p); err != nil {
+			log.Println("Profile save err:", err)
+		}
+		return "", nil, false
+	}
+
+	answer := strings.TrimSpace(text)
+	switch answer {
+	case StopAnswer:
+		i = len(onboardingSteps)
+	case SkipAnswer:
+		i++
+	default:
+		step := onboardingSteps[i]
+		if step.Numeric && !numericAnswer.MatchString(answer) {
+			return "", nil, false
+		}
+		if !step.apply(&p, answer) {
+			// Only ask again for a number out of range.
+			if !step.Numeric {
+				return "", nil, false
+			}
+			q, qReply := step.ask()
+			return "這個數字好像不太對，請再試一次，或回答「略過」。\n" + q, qReply, true
+		}
+		i++
+	}
+
+	if i < len(onboardingSteps) {
+		p.Onboarding = onboardingSteps[i].Name
+		if err := SaveProfile(ctx, uID, p); err != nil {
+			log.Println("Profile save err:", err)
+		}
+		q, qReply := onboardingSteps[i].ask()
+		return q, qReply, true
+	}
+
+	p.Onboarding = ""
+	reply := "設定完成！"
+	if kcal, ok := recommendedCalories(p); ok {
+		p.RecommendedCalories = kcal
+		reply = fmt.Sprintf("設定完成！依照你的資料，建議每日攝取約 %d 大卡。", kcal)
+		// Keep a goal the user chose on their own.
+		if p.CalorieGoal == 0 {
+			p.CalorieGoal = kcal
+			reply += "已設為你的每日目標，之後可以跟我說「每日目標改成 1800 大卡」來調整。"
+		}
+	}
+	if err := SaveProfile(ctx, uID, p); err != nil {
+		log.Println("Profile save err:", err)
+		return "無法儲存你的資料，請稍後再試。", nil, true
+	}
+	return reply + "\n\n現在可以傳送食物照片，或告訴我你吃了什麼。", nil, true
+}
+
+// recommendedCalories: The daily calories the profile needs, from the
+// Mifflin-St Jeor basal metabolic rate and the activity level. Reports false
+// when the profile lacks the age, height, weight or activity.
+func recommendedCalories(p Profile) (int, bool) {
+	if p.Age == 0 || p.HeightCm == 0 || p.WeightKg == 0 {
+		return 0, false
+	}
+	factor := 0.0
+	for _, a := range activityLevels {
+		if a.Name == p.Activity {
+			factor = a.Factor
+		}
+	}
+	if factor == 0 {
+		return 0, false
+	}
+
+	bmr := 10*p.WeightKg + 6.25*p.HeightCm - 5*float64(p.Age)
+	switch p.Sex {
+	case SexMale:
+		bmr += 5
+	case SexFemale:
+		bmr -= 161
+	default:
+		// Halfway between the two when the sex is not given.
+		bmr -= 78
+	}
+	return int(math.Round(bmr * factor)), true
+}
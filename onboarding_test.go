@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOnboardingLetsFoodThrough(t *testing.T) {
+	useTestStore(t)
+	line := useFakeLINE(t)
+	llm := useFakeLLM(t)
+	ctx := context.Background()
+	uID := "Ualice"
+	startOnboarding(ctx, uID)
+
+	// A meal at the age question is recorded as usual.
+	llm.PushFunctionCall("recordCalorie", map[string]any{"foodItem": "漢堡", "calories": 550.0}).
+		PushText("已記錄漢堡。")
+	handleEvent(ctx, textEvent(uID, "我吃了25個餃子"), time.Now())
+	if msg := line.lastMessage(t); !strings.HasPrefix(msg.Text, "已記錄漢堡。") {
+		t.Errorf("replied %q, want the meal recorded", msg.Text)
+	}
+	foods, err := GetFoods(ctx, uID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(foods) != 1 {
+		t.Errorf("stored %d entries, want 1", len(foods))
+	}
+
+	// The question is still pending.
+	p, err := GetProfile(ctx, uID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Onboarding != "age" || p.Age != 0 {
+		t.Fatalf("profile %+v, want the age question pending", p)
+	}
+
+	// A number out of range is asked again.
+	answer, _, ok := onboard(ctx, uID, "5")
+	if !ok || !strings.Contains(answer, "年齡") {
+		t.Errorf("onboard(5) = %q, %v, want the question again", answer, ok)
+	}
+	answer, _, ok = onboard(ctx, uID, "30 歲")
+	if !ok || !strings.Contains(answer, "性別") {
+		t.Errorf("onboard(30 歲) = %q, %v, want the next question", answer, ok)
+	}
+	// Free text at a choice question goes through too.
+	if _, _, ok := onboard(ctx, uID, "今天吃了什麼"); ok {
+		t.Error("onboard took free text as the sex answer")
+	}
+	if p, _ := GetProfile(ctx, uID); p.Age != 30 || p.Onboarding != "sex" {
+		t.Errorf("profile %+v, want age 30 and the sex question pending", p)
+	}
+
+	// At the diet question, which takes typed preferences, a meal and the
+	// undo keyword still go through.
+	for _, answer := range []string{"女", "160", "55", activityLevels[0].Label} {
+		if _, _, ok := onboard(ctx, uID, answer); !ok {
+			t.Fatalf("onboard(%s) not taken", answer)
+		}
+	}
+	llm.PushFunctionCall("recordCalorie", map[string]any{"foodItem": "漢堡", "calories": 550.0}).
+		PushText("已記錄漢堡。")
+	handleEvent(ctx, textEvent(uID, "我吃了一個漢堡"), time.Now())
+	if foods, _ := GetFoods(ctx, uID); len(foods) != 2 {
+		t.Errorf("stored %d entries, want the meal recorded", len(foods))
+	}
+	handleEvent(ctx, textEvent(uID, "undo"), time.Now())
+	if msg := line.lastMessage(t); !strings.HasPrefix(msg.Text, "已復原") {
+		t.Errorf("undo replied %q", msg.Text)
+	}
+	if foods, _ := GetFoods(ctx, uID); len(foods) != 1 {
+		t.Errorf("kept %d entries after undo, want 1", len(foods))
+	}
+	if p, _ := GetProfile(ctx, uID); len(p.Diet) != 0 || p.Onboarding != "diet" {
+		t.Errorf("profile %+v, want the diet question pending", p)
+	}
+
+	answer, _, ok = onboard(ctx, uID, "素食、無蛋")
+	if !ok || !strings.Contains(answer, "時區") {
+		t.Errorf("onboard(素食、無蛋) = %q, %v, want the next question", answer, ok)
+	}
+	if p, _ := GetProfile(ctx, uID); strings.Join(p.Diet, ",") != "素食,無蛋" {
+		t.Errorf("saved diet %v", p.Diet)
+	}
+}
+
+func TestDietTag(t *testing.T) {
+	for tag, want := range map[string]bool{
+		"無特殊":       true,
+		"乳糖不耐":      true,
+		"無蛋":        true,
+		"keto":      true,
+		"我吃了一個漢堡":   false,
+		"喝了珍奶":      false,
+		"2顆蛋":       false,
+		"地中海飲食的變化型": false,
+	} {
+		if got := dietTag(tag); got != want {
+			t.Errorf("dietTag(%q) = %v, want %v", tag, got, want)
+		}
+	}
+}
+
+func TestRecommendedCalories(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		p    Profile
+		want int
+		ok   bool
+	}{
+		// 10*80 + 6.25*180 - 5*30 + 5 = 1780, x1.55
+		{"male", Profile{Age: 30, Sex: SexMale, HeightCm: 180, WeightKg: 80, Activity: "moderate"}, 2759, true},
+		// 10*60 + 6.25*165 - 5*25 - 161 = 1345.25, x1.2
+		{"female", Profile{Age: 25, Sex: SexFemale, HeightCm: 165, WeightKg: 60, Activity: "sedentary"}, 1614, true},
+		// 10*70 + 6.25*170 - 5*40 - 78 = 1484.5, x1.375
+		{"unspecified sex", Profile{Age: 40, HeightCm: 170, WeightKg: 70, Activity: "light"}, 2041, true},
+		{"no age", Profile{Sex: SexMale, HeightCm: 180, WeightKg: 80, Activity: "moderate"}, 0, false},
+		{"no height", Profile{Age: 30, Sex: SexMale, WeightKg: 80, Activity: "moderate"}, 0, false},
+		{"no weight", Profile{Age: 30, Sex: SexMale, HeightCm: 180, Activity: "moderate"}, 0, false},
+		{"no activity", Profile{Age: 30, Sex: SexMale, HeightCm: 180, WeightKg: 80}, 0, false},
+		{"unknown activity", Profile{Age: 30, Sex: SexMale, HeightCm: 180, WeightKg: 80, Activity: "couch"}, 0, false},
+	} {
+		got, ok := recommendedCalories(tc.p)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%s: got %d, %v, want %d, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+}
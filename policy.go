@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// AddFriendReply asks a group member LINE does not identify to add the bot
+// as a friend.
+const AddFriendReply = "我還不知道你是誰，無法幫你記錄飲食。請先把我加為好友，之後在群組中提到我就可以記錄囉！"
+
+// botBasicID is the LINE ID of the bot, for the add friend link.
+var botBasicID string
+
+// errNoUser is returned for a personal path without a user ID.
+var errNoUser = errors.New("storage: path has an empty segment, is the user ID missing?")
+
+// Anonymous reports whether LINE did not tell who sent the event, as in
+// groups and rooms when the member did not consent to share the profile.
+func (s chatSource) Anonymous() bool {
+	return s.UserID == ""
+}
+
+// allowPersonal: Apply the personal data policy to the sender of an event.
+// Nothing is recorded or read for an anonymous sender, who is asked to add
+// the bot as a friend instead. Reports whether the event may go on.
+func allowPersonal(src chatSource, rt replyTarget) bool {
+	if !src.Anonymous() {
+		return true
+	}
+	log.Println("Anonymous sender in:", src.GroupID)
+	if err := replyMessages(rt, &messaging_api.TextMessage{
+		Text:       AddFriendReply,
+		QuickReply: addFriendQuickReply(),
+	}); err != nil {
+		log.Print(err)
+	}
+	return false
+}
+
+// addFriendQuickReply: A button opening the add friend page of the bot,
+// nil while the bot's LINE ID is unknown.
+func addFriendQuickReply() *messaging_api.QuickReply {
+	if botBasicID == "" {
+		return nil
+	}
+	return &messaging_api.QuickReply{
+		Items: []messaging_api.QuickReplyItem{
+			{
+				Action: &messaging_api.UriAction{
+					Label: "加為好友",
+					Uri:   "https://line.me/R/ti/p/" + url.PathEscape(botBasicID),
+				},
+			},
+		},
+	}
+}
+
+// guardedStore is a FoodStore refusing paths with an empty segment. A path
+// built for a missing user ID, like "food/", would otherwise read or write
+// the records of every user.
+type guardedStore struct {
+	FoodStore
+}
+
+// checkPath: Refuse a path with an empty segment.
+func checkPath(path string) error {
+	for _, seg := range strings.Split(path, "/") {
+		if seg == "" {
+			return errNoUser
+		}
+	}
+	return nil
+}
+
+// GetFromDB reads the data at a checked path.
+func (s guardedStore) GetFromDB(ctx context.Context, path string, data interface{}) error {
+	if err := checkPath(path); err != nil {
+		return err
+	}
+	return s.FoodStore.GetFromDB(ctx, path, data)
+}
+
+// InsertDB pushes data under a checked path.
+func (s guardedStore) InsertDB(ctx context.Context, path string, data interface{}) (string, error) {
+	if err := checkPath(path); err != nil {
+		return "", err
+	}
+	return s.FoodStore.InsertDB(ctx, path, data)
+}
+
+// SetDB writes data at a checked path.
+func (s guardedStore) SetDB(ctx context.Context, path string, data interface{}) error {
+	if err := checkPath(path); err != nil {
+		return err
+	}
+	return s.FoodStore.SetDB(ctx, path, data)
+}
+
+// DeleteDB removes a checked path.
+func (s guardedStore) DeleteDB(ctx context.Context, path string) error {
+	if err := checkPath(path); err != nil {
+		return err
+	}
+	return s.FoodStore.DeleteDB(ctx, path)
+}
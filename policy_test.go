@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+	bolt "go.etcd.io/bbolt"
+)
+
+// storedKeys returns every path stored in the database.
+func storedKeys(t *testing.T, db *BoltDB) []string {
+	t.Helper()
+	var keys []string
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// Webhook payloads of group and room members who did not consent to share
+// their profile: LINE leaves out the userId.
+var anonymousPayloads = map[string]string{
+	"group message": `{"type":"message","mode":"active","timestamp":1700000000000,"webhookEventId":"01HGROUPMSG","deliveryContext":{"isRedelivery":false},
+		"replyToken":"reply-group","source":{"type":"group","groupId":"Gfamily"},
+		"message":{"type":"text","id":"100","quoteToken":"q","text":"@bot 我吃了漢堡",
+			"mention":{"mentionees":[{"index":0,"length":4,"type":"user","userId":"Ubot"}]}}}`,
+	"room message": `{"type":"message","mode":"active","timestamp":1700000000000,"webhookEventId":"01HROOMMSG","deliveryContext":{"isRedelivery":false},
+		"replyToken":"reply-room","source":{"type":"room","roomId":"Rfriends"},
+		"message":{"type":"text","id":"101","quoteToken":"q","text":"@bot 我今天吃了多少",
+			"mention":{"mentionees":[{"index":0,"length":4,"type":"user","userId":"Ubot"}]}}}`,
+	"group calc postback": `{"type":"postback","mode":"active","timestamp":1700000000000,"webhookEventId":"01HGROUPCALC","deliveryContext":{"isRedelivery":false},
+		"replyToken":"reply-calc","source":{"type":"group","groupId":"Gfamily"},
+		"postback":{"data":"action=calc&m_id=100"}}`,
+	"room undo postback": `{"type":"postback","mode":"active","timestamp":1700000000000,"webhookEventId":"01HROOMUNDO","deliveryContext":{"isRedelivery":false},
+		"replyToken":"reply-undo","source":{"type":"room","roomId":"Rfriends"},
+		"postback":{"data":"action=undo"}}`,
+}
+
+func TestAnonymousSenderGetsAddFriendReply(t *testing.T) {
+	useBotUserID(t)
+	prevBasicID, prevDedup := botBasicID, dedup
+	botBasicID = "@foodbot"
+	dedup = NewEventDedup(nil, 0)
+	t.Cleanup(func() { botBasicID, dedup = prevBasicID, prevDedup })
+
+	for name, payload := range anonymousPayloads {
+		t.Run(name, func(t *testing.T) {
+			db := useTestStore(t)
+			line := useFakeLINE(t)
+			llm := useFakeLLM(t)
+			event, err := webhook.UnmarshalEvent([]byte(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handleEvent(context.Background(), event, time.Now())
+
+			if keys := storedKeys(t, db); len(keys) != 0 {
+				t.Errorf("stored %v for an anonymous sender", keys)
+			}
+			if calls := llm.Calls(); len(calls) != 0 {
+				t.Errorf("asked the model %d times for an anonymous sender", len(calls))
+			}
+			sent := line.Sent()
+			if len(sent) != 1 || sent[0].Path != "/v2/bot/message/reply" {
+				t.Fatalf("sent %+v, want a single reply", sent)
+			}
+			msg := line.lastMessage(t)
+			if msg.Text != AddFriendReply {
+				t.Errorf("replied %q, want the add friend reply", msg.Text)
+			}
+			if items := msg.QuickReply.Items; len(items) != 1 || items[0].Action.URI != "https://line.me/R/ti/p/@foodbot" {
+				t.Errorf("quick reply %+v, want the add friend link", msg.QuickReply)
+			}
+		})
+	}
+}
+
+func TestAnonymousSenderWithoutMentionIgnored(t *testing.T) {
+	db := useTestStore(t)
+	line := useFakeLINE(t)
+	useBotUserID(t)
+	event := groupTextEvent("Gfamily", "", "hi")
+	event.Message = webhook.TextMessageContent{Id: "102", Text: "大家晚安"}
+
+	handleEvent(context.Background(), event, time.Now())
+
+	if keys := storedKeys(t, db); len(keys) != 0 {
+		t.Errorf("stored %v", keys)
+	}
+	if sent := line.Sent(); len(sent) != 0 {
+		t.Errorf("answered a message not meant for the bot: %+v", sent)
+	}
+}
+
+func TestGuardedStoreRejectsEmptySegments(t *testing.T) {
+	db := useTestStore(t)
+	ctx := context.Background()
+	for _, path := range []string{"food/", "food//k1", "/food", "", "chat/"} {
+		if err := checkPath(path); !errors.Is(err, errNoUser) {
+			t.Errorf("checkPath(%q) = %v, want errNoUser", path, err)
+		}
+	}
+	if err := checkPath("food/Ualice/k1"); err != nil {
+		t.Errorf("checkPath refused a user path: %v", err)
+	}
+
+	// Every operation goes through the check.
+	var all map[string]any
+	if err := foodDB.GetFromDB(ctx, "food/", &all); !errors.Is(err, errNoUser) {
+		t.Errorf("GetFromDB = %v", err)
+	}
+	if _, err := foodDB.InsertDB(ctx, "food/", Food{Name: "漢堡"}); !errors.Is(err, errNoUser) {
+		t.Errorf("InsertDB = %v", err)
+	}
+	if err := foodDB.SetDB(ctx, "food/", Food{Name: "漢堡"}); !errors.Is(err, errNoUser) {
+		t.Errorf("SetDB = %v", err)
+	}
+	if err := foodDB.DeleteDB(ctx, "food/"); !errors.Is(err, errNoUser) {
+		t.Errorf("DeleteDB = %v", err)
+	}
+	// Built from an empty user ID.
+	if _, err := InsertFood(ctx, "", Food{Name: "漢堡"}); !errors.Is(err, errNoUser) {
+		t.Errorf("InsertFood without a user = %v", err)
+	}
+	if keys := storedKeys(t, db); len(keys) != 0 {
+		t.Errorf("stored %v", keys)
+	}
+}
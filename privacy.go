@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// ExportLinkTTL is how long a download link of an export stays valid.
+const ExportLinkTTL = 15 * time.Minute
+
+// Formats of a data export.
+const (
+	ExportJSON = "json"
+	ExportCSV  = "csv"
+)
+
+// exportKeywords and deleteKeywords are the chat messages asking for an
+// export or the deletion of the user's data.
+var (
+	exportKeywords = []string{"export my data", "匯出我的資料", "匯出資料"}
+	deleteKeywords = []string{"delete my data", "刪除我的資料", "刪除所有資料"}
+)
+
+// baseURL is the public URL of the bot server, for the download links.
+var baseURL string
+
+// exportSecret signs the download links.
+var exportSecret string
+
+// isKeyword reports whether the text is one of the keywords.
+func isKeyword(text string, keywords []string) bool {
+	text = strings.ToLower(strings.TrimSpace(text))
+	for _, k := range keywords {
+		if text == k {
+			return true
+		}
+	}
+	return false
+}
+
+// Export is everything stored about a user.
+type Export struct {
+	UserID     string                  `json:"userId"`
+	ExportedAt string                  `json:"exportedAt"`
+	Profile    Profile                 `json:"profile"`
+	Foods      map[string]Food         `json:"foods"`
+	Chat       ChatHistory             `json:"chat"`
+	Journal    map[string]journalEntry `json:"journal"`  // undoable actions, with the entries before each change
+	Analyses   map[string]Analysis     `json:"analyses"` // image descriptions by message ID
+}
+
+// exportUser: Collect the data of a user.
+func exportUser(ctx context.Context, uID string) (Export, error) {
+	e := Export{UserID: uID, ExportedAt: time.Now().UTC().Format(time.RFC3339)}
+	var err error
+	if e.Foods, err = GetFoods(ctx, uID); err != nil {
+		return e, err
+	}
+	if e.Profile, err = GetProfile(ctx, uID); err != nil {
+		return e, err
+	}
+	if e.Chat, err = GetChatHistory(ctx, uID); err != nil {
+		return e, err
+	}
+	if _, e.Journal, err = journalKeys(ctx, uID); err != nil {
+		return e, err
+	}
+	if e.Analyses, err = GetAnalyses(ctx, uID); err != nil {
+		return e, err
+	}
+	return e, nil
+}
+
+// signExport: The signature of a download link.
+func signExport(uID, format string, expire int64) string {
+	mac := hmac.New(sha256.New, []byte(exportSecret))
+	fmt.Fprintf(mac, "%s|%s|%d", uID, format, expire)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// exportURL: A signed download link of the export of a user.
+func exportURL(uID, format string, now time.Time) string {
+	expire := now.Add(ExportLinkTTL).Unix()
+	q := url.Values{}
+	q.Set("u", uID)
+	q.Set("f", format)
+	q.Set("exp", strconv.FormatInt(expire, 10))
+	q.Set("sig", signExport(uID, format, expire))
+	return strings.TrimSuffix(baseURL, "/") + "/export?" + q.Encode()
+}
+
+// exportReply: The reply to an export request, with the download links.
+func exportReply(uID string) string {
+	if baseURL == "" || exportSecret == "" {
+		return "目前無法匯出資料，請稍後再試。"
+	}
+	now := time.Now()
+	return fmt.Sprintf("你的飲食紀錄已準備好，連結在 %d 分鐘內有效:\n\nJSON (完整資料):\n%s\n\nCSV (飲食紀錄):\n%s",
+		int(ExportLinkTTL.Minutes()), exportURL(uID, ExportJSON, now), exportURL(uID, ExportCSV, now))
+}
+
+// exportHandler: Serve the export of a user through a signed link.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	uID, format := q.Get("u"), q.Get("f")
+	expire, err := strconv.ParseInt(q.Get("exp"), 10, 64)
+	if err != nil || uID == "" || exportSecret == "" ||
+		!hmac.Equal([]byte(q.Get("sig")), []byte(signExport(uID, format, expire))) {
+		http.Error(w, "invalid link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expire {
+		http.Error(w, "link expired", http.StatusGone)
+		return
+	}
+
+	e, err := exportUser(r.Context(), uID)
+	if err != nil {
+		log.Println("Export err:", err)
+		http.Error(w, "export failed", http.StatusInternalServerError)
+		return
+	}
+	name := "food-diary-" + time.Now().Format("20060102")
+	switch format {
+	case ExportJSON:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".json"))
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(e); err != nil {
+			log.Println("Export err:", err)
+		}
+	case ExportCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".csv"))
+		if err := writeFoodsCSV(w, e.Foods); err != nil {
+			log.Println("Export err:", err)
+		}
+	default:
+		http.Error(w, "unknown format", http.StatusBadRequest)
+	}
+}
+
+// writeFoodsCSV: Write the food entries as CSV, oldest first.
+func writeFoodsCSV(w io.Writer, foods map[string]Food) error {
+	keys := make([]string, 0, len(foods))
+	for k := range foods {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ti, _ := foodTime(foods[keys[i]], time.UTC)
+		tj, _ := foodTime(foods[keys[j]], time.UTC)
+		return ti.Before(tj)
+	})
+
+	// Let spreadsheet programs read the file as UTF-8.
+	if _, err := io.WriteString(w, "\ufeff"); err != nil {
+		return err
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "date", "timestamp", "meal", "name", "portion", "calories",
+		"protein", "carbs", "fat", "fiber", "sugar", "sodium", "confidence"})
+	num := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	for _, k := range keys {
+		f := foods[k]
+		cw.Write([]string{k, foodDay(f), f.Timestamp, f.Meal, f.Name, f.Portion, strconv.Itoa(f.Calories),
+			num(f.Protein), num(f.Carbs), num(f.Fat), num(f.Fiber), num(f.Sugar), num(f.Sodium), num(f.Confidence)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// deleteDataQuickReply: Buttons confirming the deletion of all the data.
+func deleteDataQuickReply() *messaging_api.QuickReply {
+	return &messaging_api.QuickReply{
+		Items: []messaging_api.QuickReplyItem{
+			{
+				Action: &messaging_api.PostbackAction{
+					Label:       "確認刪除全部",
+					Data:        "action=purge",
+					DisplayText: "確認刪除我的全部資料",
+				},
+			}, {
+				Action: &messaging_api.PostbackAction{
+					Label:       "取消",
+					Data:        "action=cancel",
+					DisplayText: "取消",
+				},
+			},
+		},
+	}
+}
+
+// deleteDataReply: Ask the user to confirm the deletion of all the data.
+func deleteDataReply() (string, *messaging_api.QuickReply) {
+	return "確定要刪除你的全部資料嗎？飲食紀錄、個人資料與對話記錄都會被永久刪除，無法復原。建議先輸入「匯出我的資料」備份。", deleteDataQuickReply()
+}
+
+// confirmDeleteData: Delete all the data of the user once confirmed.
+func confirmDeleteData(ctx context.Context, uID string) string {
+	if err := purgeUser(ctx, uID); err != nil {
+		log.Println("Delete data err:", err)
+		return "無法刪除你的資料，請稍後再試。"
+	}
+	if err := markActive(ctx, uID); err != nil {
+		log.Println("Delete data err:", err)
+	}
+	return "已刪除你的全部資料。"
+}
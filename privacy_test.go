@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedUser stores a profile, a chat, an edited entry estimated from a photo
+// and the analysis of the photo for the user.
+func seedUser(t *testing.T, uID, messageID string) {
+	t.Helper()
+	ctx := context.Background()
+	if err := SaveProfile(ctx, uID, Profile{CalorieGoal: 1800}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveChatHistory(ctx, uID, ChatHistory{Summary: "喜歡麵食"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveAnalysis(ctx, uID, messageID, "一碗牛肉麵"); err != nil {
+		t.Fatal(err)
+	}
+	f := Food{Name: "牛肉麵", Calories: 700, MessageID: messageID}
+	stampFood(&f, time.Now())
+	if _, err := InsertFood(ctx, uID, f); err != nil {
+		t.Fatal(err)
+	}
+	updateFood(ctx, uID, updateFoodArgs{entrySelector: entrySelector{FoodItem: "牛肉麵"}, Calories: ptr(650.0)})
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestExportHasEverything(t *testing.T) {
+	useTestStore(t)
+	ctx := context.Background()
+	seedUser(t, "Ualice", "m1")
+
+	e, err := exportUser(ctx, "Ualice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Foods) != 1 || e.Profile.CalorieGoal != 1800 || e.Chat.Summary != "喜歡麵食" {
+		t.Errorf("export %+v misses the records", e)
+	}
+	if len(e.Journal) != 1 {
+		t.Fatalf("exported %d journal entries, want 1", len(e.Journal))
+	}
+	for _, j := range e.Journal {
+		if len(j.Changes) != 1 || j.Changes[0].Before == nil || j.Changes[0].Before.Calories != 700 {
+			t.Errorf("journal %+v misses the entry before the edit", j)
+		}
+	}
+	if a, ok := e.Analyses["m1"]; !ok || a.Description != "一碗牛肉麵" {
+		t.Errorf("analyses %+v, want the photo description", e.Analyses)
+	}
+}
+
+func TestDeleteDataWipesUser(t *testing.T) {
+	db := useTestStore(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	prev := images
+	images = NewImageCache(1<<20, time.Hour, dir)
+	t.Cleanup(func() { images = prev })
+
+	seedUser(t, "Ualice", "m1")
+	seedUser(t, "Ubob", "m2")
+	// A photo whose description failed is found from its entries.
+	f := Food{Name: "沙拉", Calories: 200, MessageID: "m3"}
+	stampFood(&f, time.Now())
+	if _, err := InsertFood(ctx, "Ualice", f); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"m1", "m2", "m3"} {
+		images.Put(id, testImage)
+	}
+
+	if got := confirmDeleteData(ctx, "Ualice"); got != "已刪除你的全部資料。" {
+		t.Fatalf("delete answered %q", got)
+	}
+
+	for _, key := range storedKeys(t, db) {
+		if slices.Contains(strings.Split(key, "/"), "Ualice") {
+			t.Errorf("kept %s", key)
+		}
+	}
+	for _, id := range []string{"m1", "m3"} {
+		if _, ok := images.Get(id); ok {
+			t.Errorf("kept the photo %s in the cache", id)
+		}
+		if _, err := os.Stat(filepath.Join(dir, id+".img")); !os.IsNotExist(err) {
+			t.Errorf("kept the photo %s on disk", id)
+		}
+	}
+
+	// The other user keeps everything.
+	if _, ok := images.Get("m2"); !ok {
+		t.Error("deleted the photo of another user")
+	}
+	e, err := exportUser(ctx, "Ubob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Foods) != 1 || len(e.Journal) != 1 || len(e.Analyses) != 1 {
+		t.Errorf("deleted the records of another user: %+v", e)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// DBProfilePath is the path to the user profiles in the database
+const DBProfilePath = "profile"
+
+// Calories per gram of each macronutrient.
+const (
+	kcalPerGramProtein = 4
+	kcalPerGramCarbs   = 4
+	kcalPerGramFat     = 9
+)
+
+// MacroSplit is the share of the daily calories, in percent, coming from
+// each macronutrient.
+type MacroSplit struct {
+	Protein int `json:"protein"`
+	Carbs   int `json:"carbs"`
+	Fat     int `json:"fat"`
+}
+
+// Profile is the per-user setting of the bot.
+type Profile struct {
+	CalorieGoal int         `json:"calorieGoal,omitempty"`
+	MacroSplit  *MacroSplit `json:"macroSplit,omitempty"`
+	TimeZone    string      `json:"timeZone,omitempty"`
+
+	// Answers of the onboarding questionnaire.
+	Age                 int      `json:"age,omitempty"`
+	Sex                 string   `json:"sex,omitempty"`
+	HeightCm            float64  `json:"heightCm,omitempty"`
+	WeightKg            float64  `json:"weightKg,omitempty"`
+	Activity            string   `json:"activity,omitempty"`
+	Diet                []string `json:"diet,omitempty"`
+	RecommendedCalories int      `json:"recommendedCalories,omitempty"` // Mifflin-St Jeor estimate
+	Onboarding          string   `json:"onboarding,omitempty"`          // step waiting for an answer
+}
+
+// userProfilePath returns the path of the profile of a user.
+func userProfilePath(uID string) string {
+	return fmt.Sprintf("%s/%s", DBProfilePath, uID)
+}
+
+// GetProfile returns the profile of the user, empty if none was saved.
+func GetProfile(ctx context.Context, uID string) (Profile, error) {
+	var p Profile
+	err := foodDB.GetFromDB(ctx, userProfilePath(uID), &p)
+	return p, err
+}
+
+// SaveProfile stores the profile of the user.
+func SaveProfile(ctx context.Context, uID string, p Profile) error {
+	return foodDB.SetDB(ctx, userProfilePath(uID), p)
+}
+
+// setDailyGoal: 設定每日卡路里目標與營養素比例
+func setDailyGoal(ctx context.Context, uID string, calories int, split *MacroSplit) map[string]any {
+	if calories <= 0 {
+		return map[string]any{"status": "Failed", "reason": "calories must be positive"}
+	}
+	if split != nil && split.Protein+split.Carbs+split.Fat != 100 {
+		return map[string]any{"status": "Failed", "reason": "macro split must add up to 100 percent"}
+	}
+
+	p, err := GetProfile(ctx, uID)
+	if err != nil {
+		return map[string]any{"status": "Failed", "reason": err.Error()}
+	}
+	p.CalorieGoal = calories
+	if split != nil {
+		p.MacroSplit = split
+	}
+	if err := SaveProfile(ctx, uID, p); err != nil {
+		return map[string]any{"status": "Failed", "reason": err.Error()}
+	}
+
+	return map[string]any{
+		"calorieGoal": p.CalorieGoal,
+		"macroSplit":  p.MacroSplit,
+		"status":      "Success",
+	}
+}
+
+// budgetText: Describe the calories consumed and remaining on the given day,
+// computed from the stored records rather than by the model. In a group
+// chat only the entries recorded in the group are counted.
+func budgetText(ctx context.Context, uID, day string) string {
+	foods, err := visibleFoods(ctx, uID)
+	if err != nil {
+		return ""
+	}
+	total := dailyTotal(foods, day)
+	if groupOf(ctx) != "" {
+		return fmt.Sprintf("📊 %s 在這個群組記錄了 %d 大卡", day, total.Calories)
+	}
+	p, _ := GetProfile(ctx, uID)
+
+	var sb strings.Builder
+	if p.CalorieGoal <= 0 {
+		fmt.Fprintf(&sb, "📊 %s 已攝取 %d 大卡（尚未設定每日目標，可以跟我說「每日目標 1800 大卡」）", day, total.Calories)
+		return sb.String()
+	}
+
+	remaining := p.CalorieGoal - total.Calories
+	if remaining >= 0 {
+		fmt.Fprintf(&sb, "📊 %s 已攝取 %d / %d 大卡，還剩 %d 大卡", day, total.Calories, p.CalorieGoal, remaining)
+	} else {
+		fmt.Fprintf(&sb, "📊 %s 已攝取 %d / %d 大卡，超過 %d 大卡", day, total.Calories, p.CalorieGoal, -remaining)
+	}
+	if s := p.MacroSplit; s != nil {
+		fmt.Fprintf(&sb, "\n蛋白質 %.0f / %dg、碳水 %.0f / %dg、脂肪 %.0f / %dg",
+			total.Protein, p.CalorieGoal*s.Protein/100/kcalPerGramProtein,
+			total.Carbs, p.CalorieGoal*s.Carbs/100/kcalPerGramCarbs,
+			total.Fat, p.CalorieGoal*s.Fat/100/kcalPerGramFat)
+	}
+	return sb.String()
+}
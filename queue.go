@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+// Default sizing of the event queue, overridable by WORKER_COUNT and
+// QUEUE_SIZE.
+const (
+	DefaultWorkerCount = 4
+	DefaultQueueSize   = 100
+)
+
+// ReplyTokenTTL is how long after receiving an event its reply token is
+// still trusted. Answers produced later are pushed instead.
+const ReplyTokenTTL = 50 * time.Second
+
+// EventTimeout bounds the handling of a single event, Gemini and storage
+// calls included, so retries and tool rounds cannot hold a worker longer.
+const EventTimeout = 3 * time.Minute
+
+// job is a webhook event waiting for a worker.
+type job struct {
+	event    webhook.EventInterface
+	received time.Time
+}
+
+// EventQueue processes webhook events on a bounded pool of workers, so the
+// callback can acknowledge LINE before the slow Gemini and storage calls.
+type EventQueue struct {
+	jobs   chan job
+	handle func(ctx context.Context, event webhook.EventInterface, received time.Time)
+	wg     sync.WaitGroup
+	mu     sync.Mutex // serializes the producers, so the room checked stays free
+}
+
+// events is the queue fed by callbackHandler.
+var events *EventQueue
+
+// NewEventQueue starts workers goroutines reading from a queue holding up
+// to size events.
+func NewEventQueue(workers, size int, handle func(context.Context, webhook.EventInterface, time.Time)) *EventQueue {
+	if workers <= 0 {
+		workers = DefaultWorkerCount
+	}
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	q := &EventQueue{
+		jobs:   make(chan job, size),
+		handle: handle,
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	log.Printf("Event queue started: %d workers, size %d", workers, size)
+	return q
+}
+
+// Enqueue adds an event to the queue. It returns false without blocking
+// when the queue is full.
+func (q *EventQueue) Enqueue(event webhook.EventInterface) bool {
+	return q.EnqueueAll([]webhook.EventInterface{event})
+}
+
+// EnqueueAll adds all the events to the queue, or none of them when it
+// lacks room, so a batch LINE redelivers is never handled twice. It returns
+// false without blocking when the events do not fit.
+func (q *EventQueue) EnqueueAll(events []webhook.EventInterface) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if cap(q.jobs)-len(q.jobs) < len(events) {
+		return false
+	}
+	// Workers only take jobs out, so these sends do not block.
+	now := time.Now()
+	for _, event := range events {
+		q.jobs <- job{event: event, received: now}
+	}
+	return true
+}
+
+// Close stops accepting events and waits for the queued ones to finish.
+func (q *EventQueue) Close() {
+	close(q.jobs)
+	q.wg.Wait()
+}
+
+func (q *EventQueue) work() {
+	defer q.wg.Done()
+	for j := range q.jobs {
+		q.run(j)
+	}
+}
+
+// run handles a single job, keeping a panic from killing the worker.
+func (q *EventQueue) run(j job) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Event handler panic: %v", r)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), EventTimeout)
+	defer cancel()
+	q.handle(ctx, j.event, j.received)
+}
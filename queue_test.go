@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/line/line-bot-sdk-go/v8/linebot/webhook"
+)
+
+func TestEnqueueAllTakesWholeBatchOrNone(t *testing.T) {
+	block := make(chan struct{})
+	handled := make(chan string, 10)
+	q := NewEventQueue(1, 2, func(ctx context.Context, event webhook.EventInterface, received time.Time) {
+		<-block
+		handled <- event.(webhook.MessageEvent).WebhookEventId
+	})
+
+	msg := func(id string) webhook.EventInterface {
+		return webhook.MessageEvent{WebhookEventId: id}
+	}
+	// The worker holds the first event, the queue keeps two more.
+	if !q.Enqueue(msg("e1")) {
+		t.Fatal("first event rejected")
+	}
+	for len(q.jobs) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !q.EnqueueAll([]webhook.EventInterface{msg("e2")}) {
+		t.Fatal("second event rejected")
+	}
+	if q.EnqueueAll([]webhook.EventInterface{msg("e3"), msg("e4")}) {
+		t.Fatal("batch larger than the room was accepted")
+	}
+	if len(q.jobs) != 1 {
+		t.Fatalf("queue holds %d jobs, want 1", len(q.jobs))
+	}
+
+	close(block)
+	q.Close()
+	close(handled)
+	var ids []string
+	for id := range handled {
+		ids = append(ids, id)
+	}
+	if len(ids) != 2 || ids[0] != "e1" || ids[1] != "e2" {
+		t.Errorf("handled %v, want [e1 e2]", ids)
+	}
+}
+
+func TestEventHasDeadline(t *testing.T) {
+	done := make(chan bool, 1)
+	q := NewEventQueue(1, 1, func(ctx context.Context, event webhook.EventInterface, received time.Time) {
+		deadline, ok := ctx.Deadline()
+		done <- ok && time.Until(deadline) <= EventTimeout
+	})
+	q.Enqueue(webhook.MessageEvent{})
+	q.Close()
+	if !<-done {
+		t.Error("event handled without a deadline")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// Periods of a summary report.
+const (
+	PeriodDay   = "day"
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+// Summary is the aggregate of the food entries of one day, ISO week or
+// month, computed in Go so the model only has to phrase it.
+type Summary struct {
+	Period   string `json:"period"`
+	Label    string `json:"label"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Days     int    `json:"days"`
+	Entries  int    `json:"entries"`
+	Calories int    `json:"calories"`
+	Nutrients
+	AverageCalories int                  `json:"averageDailyCalories"`
+	CalorieGoal     int                  `json:"dailyCalorieGoal,omitempty"`
+	Meals           map[string]MealTotal `json:"meals,omitempty"`
+	Foods           []string             `json:"foods,omitempty"`
+}
+
+// periodRange: Get the first day of the period containing t and the first
+// day of the next one.
+func periodRange(period string, t time.Time) (time.Time, time.Time) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch period {
+	case PeriodWeek:
+		// ISO weeks start on Monday.
+		offset := (int(day.Weekday()) + 6) % 7
+		from := day.AddDate(0, 0, -offset)
+		return from, from.AddDate(0, 0, 7)
+	case PeriodMonth:
+		from := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		return from, from.AddDate(0, 1, 0)
+	}
+	return day, day.AddDate(0, 0, 1)
+}
+
+// periodLabel: Get the label of the period containing t, e.g. 2024-04-17,
+// 2024-W16 or 2024-04.
+func periodLabel(period string, t time.Time) string {
+	switch period {
+	case PeriodWeek:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case PeriodMonth:
+		return t.Format("2006-01")
+	}
+	return t.Format("2006-01-02")
+}
+
+// summarize: Aggregate the food entries of the period containing at, in the
+// time zone of at.
+func summarize(foods map[string]Food, period string, at time.Time) Summary {
+	from, to := periodRange(period, at)
+	s := Summary{
+		Period: period,
+		Label:  periodLabel(period, at),
+		From:   from.Format("2006-01-02"),
+		To:     to.AddDate(0, 0, -1).Format("2006-01-02"),
+	}
+
+	days := map[string]bool{}
+	for _, f := range foods {
+		t, ok := foodTime(f, at.Location())
+		if !ok || t.Before(from) || !t.Before(to) {
+			continue
+		}
+		days[t.Format("2006-01-02")] = true
+		s.Entries++
+		s.Calories += f.Calories
+		s.Nutrients = s.Nutrients.Add(f.Nutrients)
+		s.Foods = append(s.Foods, f.Name)
+
+		if s.Meals == nil {
+			s.Meals = map[string]MealTotal{}
+		}
+		meal := foodMeal(f, at.Location())
+		m := s.Meals[meal]
+		m.Entries++
+		m.Calories += f.Calories
+		s.Meals[meal] = m
+	}
+	sort.Strings(s.Foods)
+
+	s.Days = len(days)
+	if s.Days > 0 {
+		s.AverageCalories = s.Calories / s.Days
+	}
+	return s
+}
+
+// getSummary: 計算指定期間的飲食統計
+func getSummary(foods map[string]Food, p Profile, period, date string) map[string]any {
+	switch period {
+	case PeriodDay, PeriodWeek, PeriodMonth:
+	default:
+		period = PeriodDay
+	}
+
+	loc := userLocation(p)
+	at := time.Now().In(loc)
+	if date != "" {
+		t, err := time.ParseInLocation("2006-01-02", date, loc)
+		if err != nil {
+			return map[string]any{"status": "Failed", "reason": "date must be YYYY-MM-DD"}
+		}
+		at = t
+	}
+
+	s := summarize(foods, period, at)
+	s.CalorieGoal = p.CalorieGoal
+	return map[string]any{
+		"summary": s,
+		"status":  "Success",
+	}
+}
+
+// summaryDeclaration declares the getSummary tool.
+var summaryDeclaration = &genai.FunctionDeclaration{
+	Name:        "getSummary",
+	Description: "Get the already computed calorie and macronutrient totals of a day, ISO week or month, with a breakdown per meal. Use it for any question about what or how much was eaten.",
+	Parameters: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"period": {
+				Type:        genai.TypeString,
+				Description: "The period to summarize",
+				Format:      "enum",
+				Enum:        []string{PeriodDay, PeriodWeek, PeriodMonth},
+			},
+			"date": {
+				Type:        genai.TypeString,
+				Description: "A date inside the period in YYYY-MM-DD format, today if omitted",
+			},
+		},
+		Required: []string{"period"},
+	},
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+)
+
+// Limits of the calls to Gemini.
+const (
+	GeminiTimeout    = 60 * time.Second // of each attempt
+	GeminiRetries    = 3                // attempts after the first one
+	GeminiBackoff    = time.Second      // before the first retry, doubled on each one
+	GeminiMaxBackoff = 10 * time.Second
+	BreakerThreshold = 5 // failures in a row before calls are refused
+	BreakerCooldown  = 30 * time.Second
+)
+
+// Replies to the user when Gemini has no answer.
+const (
+	BusyReply    = "目前服務忙碌中，請稍後再試一次。"
+	BlockedReply = "抱歉，這個內容我無法回答，請換個方式描述。"
+	FailedReply  = "抱歉，我現在無法回答，請稍後再試一次。"
+)
+
+var (
+	// errBusy is returned while the circuit breaker refuses calls.
+	errBusy = errors.New("gemini: service busy")
+	// errEmptyResponse is returned when Gemini answers without content.
+	errEmptyResponse = errors.New("gemini: empty response")
+)
+
+// CircuitBreaker stops calling a failing service for a while. After
+// threshold failures in a row it refuses calls for the cooldown, then lets
+// a single probe call through: its success closes the breaker, its failure
+// opens it for another cooldown.
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+	probing   bool // the probe call is in flight
+}
+
+// NewCircuitBreaker creates a closed CircuitBreaker.
+func NewCircuitBreaker(threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// Allow reports whether a call may be made now. Every allowed call must
+// be followed by Record.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// Record counts the outcome of a call. Only failures of the service count,
+// a blocked or invalid request shows the service is up.
+func (b *CircuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil || !retryable(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		log.Printf("Circuit breaker open for %v after %d failures: %v", b.cooldown, b.failures, err)
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// retryable reports whether a failed call may succeed when tried again:
+// rate limits, server errors and timeouts.
+func retryable(err error) bool {
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		return gerr.Code == http.StatusTooManyRequests || gerr.Code >= http.StatusInternalServerError
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// checkResponse: Turn a response without usable content into an error.
+func checkResponse(resp *genai.GenerateContentResponse) error {
+	if resp == nil || len(resp.Candidates) == 0 {
+		if resp != nil && resp.PromptFeedback != nil && resp.PromptFeedback.BlockReason != genai.BlockReasonUnspecified {
+			return &genai.BlockedError{PromptFeedback: resp.PromptFeedback}
+		}
+		return errEmptyResponse
+	}
+	c := resp.Candidates[0]
+	if c.FinishReason == genai.FinishReasonSafety || c.FinishReason == genai.FinishReasonRecitation {
+		return &genai.BlockedError{Candidate: c}
+	}
+	if c.Content == nil || len(c.Content.Parts) == 0 {
+		return errEmptyResponse
+	}
+	return nil
+}
+
+// generate: Call Gemini through the circuit breaker, with a timeout on each
+// attempt and exponential backoff between retryable failures.
+func (app *GeminiApp) generate(ctx context.Context, call func(ctx context.Context) (*genai.GenerateContentResponse, error)) (*genai.GenerateContentResponse, error) {
+	if !app.breaker.Allow() {
+		return nil, errBusy
+	}
+
+	wait := GeminiBackoff
+	for attempt := 0; ; attempt++ {
+		actx, cancel := context.WithTimeout(ctx, GeminiTimeout)
+		resp, err := call(actx)
+		cancel()
+		if err == nil {
+			err = checkResponse(resp)
+		}
+		if err == nil || !retryable(err) || attempt == GeminiRetries || ctx.Err() != nil {
+			app.breaker.Record(err)
+			if err != nil {
+				return nil, err
+			}
+			return resp, nil
+		}
+
+		// Wait with some jitter, so the workers do not retry all at once.
+		// Give up if the event has no time left for another attempt.
+		sleep := wait + time.Duration(rand.Int63n(int64(wait)/2+1))
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < sleep {
+			app.breaker.Record(err)
+			return nil, err
+		}
+		log.Printf("Gemini attempt %d failed, retry in %v: %v", attempt+1, sleep, err)
+		select {
+		case <-time.After(sleep):
+		case <-ctx.Done():
+			app.breaker.Record(err)
+			return nil, ctx.Err()
+		}
+		wait = min(wait*2, GeminiMaxBackoff)
+	}
+}
+
+// geminiChat is a chat session whose messages go through generate.
+type geminiChat struct {
+	app *GeminiApp
+	cs  *genai.ChatSession
+}
+
+// SendMessage sends the parts, retrying like the other calls.
+func (c *geminiChat) SendMessage(ctx context.Context, parts ...genai.Part) (*genai.GenerateContentResponse, error) {
+	return c.app.generate(ctx, func(ctx context.Context) (*genai.GenerateContentResponse, error) {
+		// The session adds the message to its history even when the call
+		// fails, drop it so a retry does not send it twice.
+		n := len(c.cs.History)
+		resp, err := c.cs.SendMessage(ctx, parts...)
+		if err != nil {
+			c.cs.History = c.cs.History[:n]
+		}
+		return resp, err
+	})
+}
+
+// friendlyError: The reply to the user for a failed call to the model.
+func friendlyError(err error) string {
+	log.Println("Gemini err:", err)
+	var blocked *genai.BlockedError
+	switch {
+	case errors.Is(err, errBusy):
+		return BusyReply
+	case errors.As(err, &blocked):
+		return BlockedReply
+	}
+	return FailedReply
+}
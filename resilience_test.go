@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/googleapi"
+)
+
+// errUnavailable is a retryable failure of Gemini.
+var errUnavailable = &googleapi.Error{Code: http.StatusServiceUnavailable}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+	b := NewCircuitBreaker(2, cooldown)
+
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatalf("closed breaker refused call %d", i)
+		}
+		b.Record(errUnavailable)
+	}
+	if b.Allow() {
+		t.Fatal("open breaker allowed a call")
+	}
+
+	// After the cooldown a single probe goes through.
+	time.Sleep(cooldown)
+	if !b.Allow() {
+		t.Fatal("breaker refused the probe")
+	}
+	if b.Allow() {
+		t.Fatal("breaker allowed a second call during the probe")
+	}
+	// The failed probe opens the breaker for another cooldown.
+	b.Record(errUnavailable)
+	if b.Allow() {
+		t.Fatal("breaker allowed a call after the failed probe")
+	}
+
+	time.Sleep(cooldown)
+	if !b.Allow() {
+		t.Fatal("breaker refused the second probe")
+	}
+	b.Record(nil)
+	for i := 0; i < 3; i++ {
+		if !b.Allow() {
+			t.Fatal("breaker still open after a successful probe")
+		}
+	}
+}
+
+func TestGenerateStopsAtEventDeadline(t *testing.T) {
+	app := &GeminiApp{breaker: NewCircuitBreaker(BreakerThreshold, BreakerCooldown)}
+	ctx, cancel := context.WithTimeout(context.Background(), GeminiBackoff/2)
+	defer cancel()
+
+	calls := 0
+	start := time.Now()
+	_, err := app.generate(ctx, func(ctx context.Context) (*genai.GenerateContentResponse, error) {
+		calls++
+		return nil, errUnavailable
+	})
+	if !errors.Is(err, errUnavailable) {
+		t.Errorf("got %v, want the failure of the attempt", err)
+	}
+	// No time is left for the backoff, so no retry is made.
+	if calls != 1 || time.Since(start) > GeminiBackoff/2 {
+		t.Errorf("made %d calls in %v", calls, time.Since(start))
+	}
+}
+
+func TestHandleImageUsesEventContext(t *testing.T) {
+	useTestStore(t)
+	line := useFakeLINE(t)
+	llm := useFakeLLM(t)
+	llm.PushText("不該用到的描述")
+
+	// The event ran out of time before the model answered.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handleEvent(ctx, imageEvent("Ualice", "m1"), time.Now())
+
+	if msg := line.lastMessage(t); msg.AltText != "美食分析 "+FailedReply {
+		t.Errorf("sent %+v, want the failure reply", msg)
+	}
+}
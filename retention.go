@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// DBRetentionPath is the path to the users waiting for their data deletion
+const DBRetentionPath = "retention"
+
+// DefaultRetentionDays is the grace period after an unfollow before the
+// data of the user is deleted.
+const DefaultRetentionDays = 30
+
+// retentionPeriod is the grace period after an unfollow before the data of
+// the user is deleted. Following the bot again within it keeps the data.
+var retentionPeriod = DefaultRetentionDays * 24 * time.Hour
+
+// Retention is the deletion schedule of a user who unfollowed the bot.
+type Retention struct {
+	InactiveSince string `json:"inactiveSince"` // RFC 3339
+	PurgeAt       string `json:"purgeAt"`       // RFC 3339
+}
+
+// userRetentionPath returns the path of the deletion schedule of a user.
+func userRetentionPath(uID string) string {
+	return fmt.Sprintf("%s/%s", DBRetentionPath, uID)
+}
+
+// userDataPaths: The paths holding the data of a user, except the group
+// memberships.
+func userDataPaths(uID string) []string {
+	return []string{
+		userFoodPath(uID),
+		userProfilePath(uID),
+		userChatPath(uID),
+		userJournalPath(uID),
+		fmt.Sprintf("%s/%s", DBAnalysisPath, uID),
+	}
+}
+
+// markInactive: Schedule the deletion of the data of a user who unfollowed
+// the bot.
+func markInactive(ctx context.Context, uID string, now time.Time) error {
+	return foodDB.SetDB(ctx, userRetentionPath(uID), Retention{
+		InactiveSince: now.UTC().Format(time.RFC3339),
+		PurgeAt:       now.Add(retentionPeriod).UTC().Format(time.RFC3339),
+	})
+}
+
+// markActive: Cancel the deletion of the data of a user who followed the bot
+// again.
+func markActive(ctx context.Context, uID string) error {
+	return foodDB.DeleteDB(ctx, userRetentionPath(uID))
+}
+
+// purgeUser: Delete all the data of a user from the storage backend, and
+// the photos the user sent from the image cache.
+func purgeUser(ctx context.Context, uID string) error {
+	// Find the photos of the user before their records are gone.
+	messageIDs, err := userImages(ctx, uID)
+	if err != nil {
+		return err
+	}
+	for _, path := range userDataPaths(uID) {
+		if err := foodDB.DeleteDB(ctx, path); err != nil {
+			return err
+		}
+	}
+	if images != nil {
+		for _, id := range messageIDs {
+			images.Delete(id)
+		}
+	}
+
+	// Leave the diaries of the groups, the entries are already gone.
+	var groups map[string]struct {
+		Members map[string]GroupMember `json:"members"`
+	}
+	if err := foodDB.GetFromDB(ctx, DBGroupPath, &groups); err != nil {
+		return err
+	}
+	for gID, g := range groups {
+		if _, ok := g.Members[uID]; !ok {
+			continue
+		}
+		if err := foodDB.DeleteDB(ctx, fmt.Sprintf("%s/%s", groupMembersPath(gID), uID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userImages: Get the message IDs of the photos a user sent, from the image
+// analyses and the entries estimated from a photo.
+func userImages(ctx context.Context, uID string) ([]string, error) {
+	analyses, err := GetAnalyses(ctx, uID)
+	if err != nil {
+		return nil, err
+	}
+	foods, err := GetFoods(ctx, uID)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id := range analyses {
+		ids = append(ids, id)
+	}
+	for _, f := range foods {
+		if f.MessageID != "" && !slices.Contains(ids, f.MessageID) {
+			ids = append(ids, f.MessageID)
+		}
+	}
+	return ids, nil
+}
+
+// purgeInactive: Delete the data of the users whose grace period ended.
+func purgeInactive(ctx context.Context, now time.Time) {
+	var recs map[string]Retention
+	if err := foodDB.GetFromDB(ctx, DBRetentionPath, &recs); err != nil {
+		log.Println("Purge err:", err)
+		return
+	}
+	for uID, rec := range recs {
+		at, err := time.Parse(time.RFC3339, rec.PurgeAt)
+		if err != nil || now.Before(at) {
+			continue
+		}
+		log.Println("Purge data of inactive user:", uID)
+		if err := purgeUser(ctx, uID); err != nil {
+			// Keep the schedule, the next run tries again.
+			log.Println("Purge err:", err)
+			continue
+		}
+		if err := markActive(ctx, uID); err != nil {
+			log.Println("Purge err:", err)
+		}
+	}
+}
+
+// PurgeEvery runs purgeInactive periodically in the background.
+func PurgeEvery(interval time.Duration) {
+	go func() {
+		purgeInactive(context.Background(), time.Now())
+		for range time.Tick(interval) {
+			purgeInactive(context.Background(), time.Now())
+		}
+	}()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+)
+
+// FoodStore is the storage backend holding the food records. Every call
+// names the path it works on, so concurrent requests never share state.
+type FoodStore interface {
+	// GetFromDB reads the data at path.
+	GetFromDB(ctx context.Context, path string, data interface{}) error
+	// InsertDB pushes data as a new child of path and returns its key.
+	InsertDB(ctx context.Context, path string, data interface{}) (string, error)
+	// SetDB writes data at path, replacing what was there.
+	SetDB(ctx context.Context, path string, data interface{}) error
+	// DeleteDB removes path and all of its children.
+	DeleteDB(ctx context.Context, path string) error
+}
+
+// Storage backends selectable by DB_BACKEND.
+const (
+	BackendFirebase = "firebase"
+	BackendBolt     = "bolt"
+)
+
+// DefaultBoltPath is the database file used when BOLT_DB_PATH is not set.
+const DefaultBoltPath = "food.db"
+
+// foodDB is the storage backend used by the bot.
+var foodDB FoodStore
+
+// initStore: Initialize the storage backend selected by the environment.
+// It returns a function to release the backend.
+func initStore() func() {
+	switch backend := os.Getenv("DB_BACKEND"); backend {
+	case BackendBolt:
+		path := os.Getenv("BOLT_DB_PATH")
+		if path == "" {
+			path = DefaultBoltPath
+		}
+		boltDB, err := initBoltDB(path)
+		if err != nil {
+			log.Fatalf("error opening bolt database: %v", err)
+		}
+		foodDB = guardedStore{boltDB}
+		return func() { boltDB.Close() }
+	case "", BackendFirebase:
+		gaeKey := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+		firebaseURL := os.Getenv("FIREBASE_URL")
+		foodDB = guardedStore{initFirebase(gaeKey, firebaseURL, context.Background())}
+		return func() {}
+	default:
+		log.Fatalf("unknown DB_BACKEND: %s", backend)
+	}
+	return nil
+}
+
+// userFoodPath returns the path of the food records of a user.
+func userFoodPath(uID string) string {
+	return fmt.Sprintf("%s/%s", DBFoodPath, uID)
+}
+
+// InsertFood stores a food record for the user and returns its key.
+func InsertFood(ctx context.Context, uID string, food Food) (string, error) {
+	return foodDB.InsertDB(ctx, userFoodPath(uID), food)
+}
+
+// UpdateFood replaces the food record with the given key.
+func UpdateFood(ctx context.Context, uID, key string, food Food) error {
+	return foodDB.SetDB(ctx, fmt.Sprintf("%s/%s", userFoodPath(uID), key), food)
+}
+
+// GetFoods returns all food records of the user keyed by record ID.
+func GetFoods(ctx context.Context, uID string) (map[string]Food, error) {
+	var foods map[string]Food
+	if err := foodDB.GetFromDB(ctx, userFoodPath(uID), &foods); err != nil {
+		return nil, err
+	}
+	// Records saved before timestamps are converted on first read.
+	migrateFoods(ctx, uID, foods)
+	return foods, nil
+}
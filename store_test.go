@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useTestStore points foodDB at a BoltDB in a temporary file for the test.
+func useTestStore(t *testing.T) *BoltDB {
+	t.Helper()
+	db, err := initBoltDB(filepath.Join(t.TempDir(), "food.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := foodDB
+	foodDB = guardedStore{db}
+	t.Cleanup(func() {
+		foodDB = prev
+		db.Close()
+	})
+	return db
+}
+
+// TestConcurrentUsersIsolated records for two users at the same time and
+// checks every entry lands in the diary of its own user. Run with -race.
+func TestConcurrentUsersIsolated(t *testing.T) {
+	useTestStore(t)
+	ctx := context.Background()
+	users := []string{"Ualice", "Ubob"}
+	const n = 20
+
+	var wg sync.WaitGroup
+	for _, uID := range users {
+		uID := uID
+		// Chat records, like GeminiFunctionCall.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				recordCalorie(ctx, uID, fmt.Sprintf("%s-chat-%d", uID, i), "", 100, "", Nutrients{})
+			}
+		}()
+		// Image records, like processImage.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				f := Food{Name: fmt.Sprintf("%s-image-%d", uID, i), Calories: 200, MessageID: "m"}
+				stampFood(&f, time.Now())
+				if _, err := InsertFood(ctx, uID, f); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, uID := range users {
+		foods, err := GetFoods(ctx, uID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(foods) != 2*n {
+			t.Errorf("%s has %d entries, want %d", uID, len(foods), 2*n)
+		}
+		for k, f := range foods {
+			if !strings.HasPrefix(f.Name, uID+"-") {
+				t.Errorf("%s holds entry %s of another user: %s", userFoodPath(uID), k, f.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// DefaultTimeZone is used for users without a time zone in their profile.
+const DefaultTimeZone = "Asia/Taipei"
+
+// dayLayout is the layout of the normalized local date of a food entry.
+const dayLayout = "2006-01-02"
+
+// userLocation: Get the time zone of the user, DefaultTimeZone if unset.
+func userLocation(p Profile) *time.Location {
+	name := p.TimeZone
+	if name == "" {
+		name = DefaultTimeZone
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.FixedZone(DefaultTimeZone, 8*60*60)
+	}
+	return loc
+}
+
+// validTimeZone: Check name is an IANA time zone such as Asia/Taipei or UTC.
+// "Local" and "" also load, but as the zone of the server.
+func validTimeZone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// userNow: Get the current time in the time zone of the user.
+func userNow(ctx context.Context, uID string) time.Time {
+	p, err := GetProfile(ctx, uID)
+	if err != nil {
+		log.Println("Profile read err:", err)
+	}
+	return time.Now().In(userLocation(p))
+}
+
+// stampFood: Set the timestamp and local date of an entry eaten at t.
+func stampFood(f *Food, t time.Time) {
+	f.Timestamp = t.Format(time.RFC3339)
+	f.Date = t.Format(dayLayout)
+}
+
+// intakeTime: Get the time of an intake reported for a YYYY-MM-DD date.
+// Today, or an unreadable date, is now; a past day without a time of day is
+// recorded at noon.
+func intakeTime(date string, now time.Time) time.Time {
+	day, err := time.ParseInLocation(dayLayout, date, now.Location())
+	if err != nil || day.Format(dayLayout) == now.Format(dayLayout) {
+		return now
+	}
+	return day.Add(12 * time.Hour)
+}
+
+// foodTime: Get the time of a food entry in loc.
+func foodTime(f Food, loc *time.Location) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, f.Timestamp); err == nil {
+		return t.In(loc), true
+	}
+	if t, err := time.ParseInLocation(dayLayout, f.Date, loc); err == nil {
+		return t, true
+	}
+	t, _, ok := parseLegacyTime(f.LegacyTime, loc)
+	return t, ok
+}
+
+// foodDay: Get the YYYY-MM-DD local day of a food entry.
+func foodDay(f Food) string {
+	if f.Date != "" || len(f.LegacyTime) < len(dayLayout) {
+		return f.Date
+	}
+	return f.LegacyTime[:len(dayLayout)]
+}
+
+// parseLegacyTime: Parse the free-form time of a record saved before
+// timestamps, either time.Time String() or YYYY-MM-DD, reporting whether
+// it had a time of day.
+func parseLegacyTime(s string, loc *time.Location) (time.Time, bool, bool) {
+	// Drop the monotonic clock reading of time.String().
+	if i := strings.Index(s, " m="); i >= 0 {
+		s = s[:i]
+	}
+	if t, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", s); err == nil {
+		return t.In(loc), true, true
+	}
+	if len(s) >= len(dayLayout) {
+		if t, err := time.ParseInLocation(dayLayout, s[:len(dayLayout)], loc); err == nil {
+			return t, false, true
+		}
+	}
+	return time.Time{}, false, false
+}
+
+// normalizeFood: Convert the legacy time of an entry to a timestamp and
+// local date, reporting whether the entry changed.
+func normalizeFood(f *Food, loc *time.Location) bool {
+	if f.Timestamp != "" || f.LegacyTime == "" {
+		return false
+	}
+	t, hasClock, ok := parseLegacyTime(f.LegacyTime, loc)
+	if !ok {
+		return false
+	}
+	stampFood(f, t)
+	if f.Meal == "" {
+		f.Meal = MealOther
+		if hasClock {
+			f.Meal = inferMeal(t)
+		}
+	}
+	f.LegacyTime = ""
+	return true
+}
+
+// migrateFoods: Normalize the legacy entries of a user in place and save
+// them back.
+func migrateFoods(ctx context.Context, uID string, foods map[string]Food) {
+	var loc *time.Location
+	for key, f := range foods {
+		if f.Timestamp != "" || f.LegacyTime == "" {
+			continue
+		}
+		if loc == nil {
+			p, err := GetProfile(ctx, uID)
+			if err != nil {
+				log.Println("Profile read err:", err)
+			}
+			loc = userLocation(p)
+		}
+		if !normalizeFood(&f, loc) {
+			continue
+		}
+		foods[key] = f
+		if err := UpdateFood(ctx, uID, key, f); err != nil {
+			log.Println("Migrate food err:", err)
+		}
+	}
+}
+
+// migrateAllFoods: Normalize the legacy entries of every user.
+func migrateAllFoods(ctx context.Context) error {
+	var all map[string]map[string]Food
+	if err := foodDB.GetFromDB(ctx, DBFoodPath, &all); err != nil {
+		return err
+	}
+	for uID, foods := range all {
+		migrateFoods(ctx, uID, foods)
+	}
+	log.Printf("Migrated food dates of %d users", len(all))
+	return nil
+}
+
+// setTimeZone: 設定使用者的時區
+func setTimeZone(ctx context.Context, uID, name string) map[string]any {
+	if !validTimeZone(name) {
+		return map[string]any{"status": "Failed", "reason": fmt.Sprintf("unknown time zone %q, use an IANA name such as Asia/Taipei", name)}
+	}
+	p, err := GetProfile(ctx, uID)
+	if err != nil {
+		return map[string]any{"status": "Failed", "reason": err.Error()}
+	}
+	p.TimeZone = name
+	if err := SaveProfile(ctx, uID, p); err != nil {
+		return map[string]any{"status": "Failed", "reason": err.Error()}
+	}
+	return map[string]any{
+		"timeZone":  name,
+		"localTime": time.Now().In(userLocation(p)).Format(time.RFC3339),
+		"status":    "Success",
+	}
+}
+
+// timeZoneDeclaration declares the setTimeZone tool.
+var timeZoneDeclaration = &genai.FunctionDeclaration{
+	Name:        "setTimeZone",
+	Description: "Set the time zone of the user, used for dates and daily totals",
+	Parameters: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"timeZone": {
+				Type:        genai.TypeString,
+				Description: "IANA time zone name, e.g. Asia/Taipei or America/New_York",
+			},
+		},
+		Required: []string{"timeZone"},
+	},
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestValidTimeZone(t *testing.T) {
+	for name, want := range map[string]bool{
+		"Asia/Taipei":                    true,
+		"America/Argentina/Buenos_Aires": true,
+		"Etc/UTC":                        true,
+		"Local":                          false,
+		"":                               false,
+		"UTC":                            true,
+		"Asia/":                          false,
+		"/Taipei":                        false,
+		"Asia/Nowhere":                   false,
+	} {
+		if got := validTimeZone(name); got != want {
+			t.Errorf("validTimeZone(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestSetTimeZoneRejectsServerZone(t *testing.T) {
+	useTestStore(t)
+	ctx := context.Background()
+	for _, name := range []string{"Local", ""} {
+		if got := setTimeZone(ctx, "Ualice", name); got["status"] != "Failed" {
+			t.Errorf("setTimeZone(%q) = %v, want Failed", name, got)
+		}
+	}
+	p, err := GetProfile(ctx, "Ualice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.TimeZone != "" {
+		t.Errorf("saved time zone %q", p.TimeZone)
+	}
+
+	// The onboarding answer is checked the same way.
+	step := onboardingSteps[len(onboardingSteps)-1]
+	if step.Name != "timeZone" {
+		t.Fatalf("last onboarding step is %s", step.Name)
+	}
+	if step.apply(&p, "Local") {
+		t.Error("onboarding accepted the Local time zone")
+	}
+	if !step.apply(&p, "台灣") || p.TimeZone != "Asia/Taipei" {
+		t.Errorf("onboarding saved %q for 台灣", p.TimeZone)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/line/line-bot-sdk-go/v8/linebot/messaging_api"
+)
+
+// toolResult is the outcome of a tool call.
+type toolResult struct {
+	// Response is sent back to the model as the FunctionResponse.
+	Response map[string]any
+	// BudgetDay is the day whose budget is appended to the answer.
+	BudgetDay string
+	// QuickReply is attached to the answer to the user.
+	QuickReply *messaging_api.QuickReply
+}
+
+// Tool is a function Gemini may call: its declaration and the Go handler
+// receiving the decoded arguments.
+type Tool struct {
+	Declaration *genai.FunctionDeclaration
+	call        func(ctx context.Context, uID string, args map[string]any) (toolResult, error)
+}
+
+// newTool: Build a Tool whose handler takes the arguments decoded into A
+// through their JSON field names.
+func newTool[A any](decl *genai.FunctionDeclaration, handle func(ctx context.Context, uID string, args A) toolResult) *Tool {
+	return &Tool{
+		Declaration: decl,
+		call: func(ctx context.Context, uID string, raw map[string]any) (toolResult, error) {
+			var args A
+			data, err := json.Marshal(raw)
+			if err != nil {
+				return toolResult{}, err
+			}
+			if err := json.Unmarshal(data, &args); err != nil {
+				return toolResult{}, err
+			}
+			return handle(ctx, uID, args), nil
+		},
+	}
+}
+
+// ToolRegistry holds the tools offered to Gemini and dispatches its
+// function calls to them.
+type ToolRegistry struct {
+	tools map[string]*Tool
+	order []string
+}
+
+// NewToolRegistry creates a registry holding the given tools.
+func NewToolRegistry(tools ...*Tool) *ToolRegistry {
+	r := &ToolRegistry{tools: map[string]*Tool{}}
+	for _, t := range tools {
+		r.Register(t)
+	}
+	return r
+}
+
+// Register adds a tool, replacing any tool of the same name.
+func (r *ToolRegistry) Register(t *Tool) {
+	name := t.Declaration.Name
+	if _, ok := r.tools[name]; !ok {
+		r.order = append(r.order, name)
+	}
+	r.tools[name] = t
+}
+
+// With returns a registry holding the tools of r and the given ones.
+func (r *ToolRegistry) With(tools ...*Tool) *ToolRegistry {
+	ret := NewToolRegistry()
+	for _, name := range r.order {
+		ret.Register(r.tools[name])
+	}
+	for _, t := range tools {
+		ret.Register(t)
+	}
+	return ret
+}
+
+// GenaiTool returns the declarations of all tools, in registration order.
+func (r *ToolRegistry) GenaiTool() *genai.Tool {
+	decls := make([]*genai.FunctionDeclaration, 0, len(r.order))
+	for _, name := range r.order {
+		decls = append(decls, r.tools[name].Declaration)
+	}
+	return &genai.Tool{FunctionDeclarations: decls}
+}
+
+// Dispatch runs the tool a function call asks for. The FunctionResponse
+// always carries the name of the call, and reports failures to the model
+// rather than to the user.
+func (r *ToolRegistry) Dispatch(ctx context.Context, uID string, call genai.FunctionCall) (genai.FunctionResponse, toolResult) {
+	fmt.Printf("Received function call response:\n %s \n %v \n", call.Name, call.Args)
+
+	var result toolResult
+	if t, ok := r.tools[call.Name]; !ok {
+		result.Response = map[string]any{"status": "Failed", "reason": "unknown function " + call.Name}
+	} else if res, err := t.call(ctx, uID, call.Args); err != nil {
+		log.Printf("Tool %s err: %v", call.Name, err)
+		result.Response = map[string]any{"status": "Failed", "reason": err.Error()}
+	} else {
+		result = res
+	}
+	fmt.Printf("Sending API result:\n%q\n\n", result.Response)
+
+	return genai.FunctionResponse{Name: call.Name, Response: result.Response}, result
+}
+
+// recordCalorieArgs are the arguments of recordCalorie.
+type recordCalorieArgs struct {
+	FoodItem string  `json:"foodItem"`
+	Date     string  `json:"date"`
+	Calories float64 `json:"calories"`
+	Meal     string  `json:"meal"`
+	Nutrients
+}
+
+// recordFoodArgs are the arguments of recordFood.
+type recordFoodArgs struct {
+	FoodItem string `json:"foodItem"`
+	Date     string `json:"date"`
+	Meal     string `json:"meal"`
+}
+
+// setDailyGoalArgs are the arguments of setDailyGoal.
+type setDailyGoalArgs struct {
+	Calories       float64  `json:"calories"`
+	ProteinPercent *float64 `json:"proteinPercent"`
+	CarbsPercent   *float64 `json:"carbsPercent"`
+	FatPercent     *float64 `json:"fatPercent"`
+}
+
+// getSummaryArgs are the arguments of getSummary.
+type getSummaryArgs struct {
+	Period string `json:"period"`
+	Date   string `json:"date"`
+}
+
+// setTimeZoneArgs are the arguments of setTimeZone.
+type setTimeZoneArgs struct {
+	TimeZone string `json:"timeZone"`
+}
+
+// recordedResult: The result of a recording tool, with the day's budget
+// and an undo button for the user.
+func recordedResult(ctx context.Context, uID string, apiResult map[string]any) toolResult {
+	date, _ := apiResult["date"].(string)
+	return toolResult{
+		Response:   apiResult,
+		BudgetDay:  date,
+		QuickReply: undoQuickReply(),
+	}
+}
+
+// calorieTools are the tools offered to Gemini for chat messages.
+var calorieTools = NewToolRegistry(
+	newTool(recordCalorieDeclaration, func(ctx context.Context, uID string, args recordCalorieArgs) toolResult {
+		apiResult := recordCalorie(ctx, uID, args.FoodItem, args.Date, int(args.Calories), args.Meal, args.Nutrients)
+		return recordedResult(ctx, uID, apiResult)
+	}),
+	newTool(recordFoodDeclaration, func(ctx context.Context, uID string, args recordFoodArgs) toolResult {
+		fmt.Println("Asking Gemini to guess the calories...")
+		// using default prompt to ask user.
+		prompt := fmt.Sprintf("我剛剛吃了 %s, 請幫我猜測卡路里，大概就好，只要回覆我數字。", args.FoodItem)
+		guess, err := gemini.GeminiChatComplete(ctx, prompt)
+		if err != nil {
+			return toolResult{Response: map[string]any{"status": "Failed", "reason": err.Error()}}
+		}
+		calories := int(toNumber(guess))
+		fmt.Println("gemini guess calories: ", calories)
+		if calories <= 0 {
+			return toolResult{Response: map[string]any{"status": "Failed", "reason": "cannot guess the calories"}}
+		}
+		apiResult := recordCalorie(ctx, uID, args.FoodItem, args.Date, calories, args.Meal, Nutrients{})
+		return recordedResult(ctx, uID, apiResult)
+	}),
+	newTool(setDailyGoalDeclaration, func(ctx context.Context, uID string, args setDailyGoalArgs) toolResult {
+		// The split is optional, only set it when all parts are given.
+		var split *MacroSplit
+		if args.ProteinPercent != nil && args.CarbsPercent != nil && args.FatPercent != nil {
+			split = &MacroSplit{
+				Protein: int(*args.ProteinPercent),
+				Carbs:   int(*args.CarbsPercent),
+				Fat:     int(*args.FatPercent),
+			}
+		}
+		return toolResult{Response: setDailyGoal(ctx, uID, int(args.Calories), split)}
+	}),
+	newTool(summaryDeclaration, func(ctx context.Context, uID string, args getSummaryArgs) toolResult {
+		foods, err := visibleFoods(ctx, uID)
+		if err != nil {
+			return toolResult{Response: map[string]any{"status": "Failed", "reason": err.Error()}}
+		}
+		profile, err := GetProfile(ctx, uID)
+		if err != nil {
+			log.Println("Profile read err:", err)
+		}
+		return toolResult{Response: getSummary(foods, profile, args.Period, args.Date)}
+	}),
+	newTool(timeZoneDeclaration, func(ctx context.Context, uID string, args setTimeZoneArgs) toolResult {
+		return toolResult{Response: setTimeZone(ctx, uID, args.TimeZone)}
+	}),
+	newTool(updateFoodDeclaration, func(ctx context.Context, uID string, args updateFoodArgs) toolResult {
+		return toolResult{Response: updateFood(ctx, uID, args), QuickReply: undoQuickReply()}
+	}),
+	newTool(deleteFoodDeclaration, func(ctx context.Context, uID string, args entrySelector) toolResult {
+		// The entry is only removed once the user taps the confirmation.
+		apiResult, qReply := deleteFood(ctx, uID, args)
+		return toolResult{Response: apiResult, QuickReply: qReply}
+	}),
+)
+
+// recordCalorieDeclaration declares the recordCalorie tool.
+var recordCalorieDeclaration = &genai.FunctionDeclaration{
+	Name:        "recordCalorie",
+	Description: "Record a calorie intake with date, amount, food item and the estimated macronutrients",
+	Parameters: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: withNutrients(map[string]*genai.Schema{
+			"foodItem": {
+				Type:        genai.TypeString,
+				Description: "The name of the food item",
+			},
+			"date": {
+				Type:        genai.TypeString,
+				Description: "The date of the intake in YYYY-MM-DD format",
+			},
+			"calories": {
+				Type:        genai.TypeNumber,
+				Description: "The amount of calories",
+			},
+			"meal": mealSchema,
+		}),
+		Required: []string{"foodItem", "date", "calories"},
+	},
+}
+
+// recordFoodDeclaration declares the recordFood tool.
+var recordFoodDeclaration = &genai.FunctionDeclaration{
+	Name:        "recordFood",
+	Description: "Record a eating with date and food item",
+	Parameters: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"foodItem": {
+				Type:        genai.TypeString,
+				Description: "The name of the food item",
+			},
+			"date": {
+				Type:        genai.TypeString,
+				Description: "The date of the intake in YYYY-MM-DD format",
+			},
+			"meal": mealSchema,
+		},
+		Required: []string{"foodItem", "date"},
+	},
+}
+
+// setDailyGoalDeclaration declares the setDailyGoal tool.
+var setDailyGoalDeclaration = &genai.FunctionDeclaration{
+	Name:        "setDailyGoal",
+	Description: "Set the daily calorie target and optionally the macronutrient split",
+	Parameters: &genai.Schema{
+		Type: genai.TypeObject,
+		Properties: map[string]*genai.Schema{
+			"calories": {
+				Type:        genai.TypeNumber,
+				Description: "The daily calorie target in kcal",
+			},
+			"proteinPercent": {
+				Type:        genai.TypeNumber,
+				Description: "Percent of the daily calories from protein",
+			},
+			"carbsPercent": {
+				Type:        genai.TypeNumber,
+				Description: "Percent of the daily calories from carbohydrate",
+			},
+			"fatPercent": {
+				Type:        genai.TypeNumber,
+				Description: "Percent of the daily calories from fat",
+			},
+		},
+		Required: []string{"calories"},
+	},
+}
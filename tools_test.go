@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/generative-ai-go/genai"
+)
+
+// echoArgs are the arguments of the echo test tool.
+type echoArgs struct {
+	Text  string  `json:"text"`
+	Count float64 `json:"count"`
+}
+
+// testTool: A tool named name echoing its arguments.
+func testTool(name string) *Tool {
+	return newTool(&genai.FunctionDeclaration{Name: name}, func(ctx context.Context, uID string, args echoArgs) toolResult {
+		return toolResult{
+			Response:  map[string]any{"status": "Success", "uid": uID, "text": args.Text, "count": args.Count},
+			BudgetDay: "2024-04-17",
+		}
+	})
+}
+
+func TestDispatch(t *testing.T) {
+	ctx := context.Background()
+	r := NewToolRegistry(testTool("echo"))
+
+	for _, tc := range []struct {
+		name   string
+		call   genai.FunctionCall
+		status string
+		reason string
+	}{
+		{"known", genai.FunctionCall{Name: "echo", Args: map[string]any{"text": "hi", "count": 2.0}}, "Success", ""},
+		{"unknown", genai.FunctionCall{Name: "launchRocket", Args: map[string]any{}}, "Failed", "unknown function launchRocket"},
+		{"bad args", genai.FunctionCall{Name: "echo", Args: map[string]any{"count": "two"}}, "Failed", "cannot unmarshal string"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, result := r.Dispatch(ctx, "Ualice", tc.call)
+			if resp.Name != tc.call.Name {
+				t.Errorf("response name %q, want %q", resp.Name, tc.call.Name)
+			}
+			if resp.Response["status"] != tc.status {
+				t.Errorf("status %v, want %s", resp.Response["status"], tc.status)
+			}
+			reason, _ := resp.Response["reason"].(string)
+			if tc.reason != "" && !strings.Contains(reason, tc.reason) {
+				t.Errorf("reason %q, want %q", reason, tc.reason)
+			}
+			if tc.status == "Failed" && result.BudgetDay != "" {
+				t.Errorf("failed call shows the budget of %s", result.BudgetDay)
+			}
+		})
+	}
+
+	resp, result := r.Dispatch(ctx, "Ualice", genai.FunctionCall{Name: "echo", Args: map[string]any{"text": "hi", "count": 2.0}})
+	if resp.Response["uid"] != "Ualice" || resp.Response["text"] != "hi" || resp.Response["count"] != 2.0 {
+		t.Errorf("handler got %v", resp.Response)
+	}
+	if result.BudgetDay != "2024-04-17" {
+		t.Errorf("result budget day %q", result.BudgetDay)
+	}
+}
+
+func TestToolRegistryOrder(t *testing.T) {
+	base := NewToolRegistry(testTool("a"), testTool("b"))
+	r := base.With(testTool("c"), testTool("a"))
+
+	names := func(r *ToolRegistry) string {
+		var ret []string
+		for _, d := range r.GenaiTool().FunctionDeclarations {
+			ret = append(ret, d.Name)
+		}
+		return strings.Join(ret, ",")
+	}
+	// Replacing a tool keeps its place.
+	if got := names(r); got != "a,b,c" {
+		t.Errorf("With declares %s, want a,b,c", got)
+	}
+	if got := names(base); got != "a,b" {
+		t.Errorf("With changed the base registry to %s", got)
+	}
+
+	// The group registry extends the personal one.
+	personal := names(calorieTools)
+	if got := names(groupTools); !strings.HasPrefix(got, personal+",") {
+		t.Errorf("group tools %s do not extend %s", got, personal)
+	}
+}